@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	rice "github.com/GeertJohan/go.rice"
@@ -16,12 +19,14 @@ import (
 //
 // It can be serialized to JSON and is what gets reported to admin API endpoint.
 type ReportingStatus struct {
-	Node        string         `json:"node"`
-	Status      string         `json:"status"`
-	Reported    int64          `json:"reported_at"`
-	StartupTime int64          `json:"startup_time"`
-	SentMsgs    uint64         `json:"msgs_broadcast"`
-	Connections connStatusList `json:"connections"`
+	Node          string            `json:"node"`
+	Status        string            `json:"status"`
+	Reported      int64             `json:"reported_at"`
+	StartupTime   int64             `json:"startup_time"`
+	SentMsgs      uint64            `json:"msgs_broadcast"`
+	SlowConsumers SlowConsumerStats `json:"slow_consumers"`
+	Backplane     *BackplaneStatus  `json:"backplane,omitempty"`
+	Connections   connStatusList    `json:"connections"`
 }
 
 // implements sort.Interface to enable []connectionStatus to be sorted by age
@@ -35,24 +40,46 @@ func (cl connStatusList) Less(i, j int) bool { return cl[i].Created < cl[j].Crea
 //
 // Primarily intended for logging and reporting.
 func (s *Server) Status() ReportingStatus {
+	snap := s.hub.snapshot()
 
 	stats := ReportingStatus{
-		Node:        fmt.Sprintf("%s-%s-%s", platform(), env(), nodeName()),
-		Status:      "OK",
-		Reported:    time.Now().Unix(),
-		StartupTime: s.hub.startupTime.Unix(),
-		SentMsgs:    s.hub.sentMsgs,
+		Node:          fmt.Sprintf("%s-%s-%s", platform(), env(), nodeName()),
+		Status:        "OK",
+		Reported:      time.Now().Unix(),
+		StartupTime:   s.hub.startupTime.Unix(),
+		SentMsgs:      snap.sentMsgs,
+		SlowConsumers: snap.slowConsumers,
+		Connections:   connStatusList(snap.connections),
 	}
-
-	stats.Connections = connStatusList{}
-	for k := range s.hub.connections {
-		stats.Connections = append(stats.Connections, k.Status())
+	if r, ok := s.Options.Backplane.(BackplaneStatusReporter); ok {
+		bs := r.Status()
+		stats.Backplane = &bs
+	}
+	if stats.Connections == nil {
+		stats.Connections = connStatusList{}
 	}
 	sort.Sort(stats.Connections)
 
 	return stats
 }
 
+// KickEvent is the event type of the message sent to a connection to explain
+// why it is being disconnected by Kick.
+const KickEvent = "disconnect"
+
+// Kick disconnects the connection with the given ID, as found in its
+// ConnectionInfo or the admin status. If reason is set, it is first sent to the
+// client as the data of a KickEvent, should there be room in its send buffer.
+//
+// Returns false if there is no such connection.
+func (s *Server) Kick(id uint64, reason string) bool {
+	var farewell []byte
+	if reason != "" {
+		farewell = SSEMessage{Event: KickEvent, Data: []byte(reason)}.sseFormat()
+	}
+	return s.hub.kick(id, farewell)
+}
+
 // The name of the platform we are running on. For now this is just "go", and is
 // more or less a legacy from when there was also a Ruby and NodeJS version of
 // this server.
@@ -110,6 +137,90 @@ func adminStatusDataHandler(w http.ResponseWriter, r *http.Request, s *Server) {
 	fmt.Fprint(w, string(b))
 }
 
+// Handles the API endpoints for individual connections:
+//
+//	GET  /admin/connections/:id       status of the connection, as JSON
+//	POST /admin/connections/:id/kick  disconnect it, see Server.Kick, with an
+//	                                  optional "reason" form value
+//
+// Kicking is only possible when there is an AdminAuthorizer to allow it, and
+// only from the same origin, so that other web pages cannot do so on behalf of
+// whoever is visiting them.
+func adminConnectionHandler(w http.ResponseWriter, r *http.Request, s *Server) {
+	path := strings.TrimPrefix(r.URL.Path, "/admin/connections/")
+	idStr, action := cutSegment(path)
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st, ok := s.hub.connectionStatus(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		b, _ := json.MarshalIndent(st, "", "  ")
+		fmt.Fprint(w, string(b))
+	case "kick":
+		authorizer := s.Options.AdminAuthorizer
+		if authorizer == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "403 cross-origin request", http.StatusForbidden)
+			return
+		}
+		st, ok := s.hub.connectionStatus(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if auth := authorizer.Authorize(r, st.Namespace); auth.Deny {
+			auth.deny(w)
+			return
+		}
+		if !s.Kick(id, r.FormValue("reason")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sameOrigin reports whether a request was made from a page on the same origin
+// as it is for, or not from a web page at all, judging by the Sec-Fetch-Site
+// and Origin headers browsers send.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
 func adminHandler(s *Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if s.Options.DisableAdminEndpoints {
@@ -122,6 +233,12 @@ func adminHandler(s *Server) http.Handler {
 		mux.HandleFunc("/admin/status.json", func(w http.ResponseWriter, r *http.Request) {
 			adminStatusDataHandler(w, r, s)
 		})
+		mux.HandleFunc("/admin/connections/", func(w http.ResponseWriter, r *http.Request) {
+			adminConnectionHandler(w, r, s)
+		})
+		mux.HandleFunc("/admin/metrics", func(w http.ResponseWriter, r *http.Request) {
+			adminMetricsHandler(w, r, s)
+		})
 		mux.ServeHTTP(w, r)
 	})
 }
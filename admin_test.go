@@ -1,8 +1,15 @@
 package sseserver
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -61,7 +68,7 @@ func TestAdminDisableEndpoints(t *testing.T) {
 	defer s.hub.Shutdown()
 	s.Options.DisableAdminEndpoints = true
 
-	for _, path := range []string{"/admin/", "/admin/status.json"} {
+	for _, path := range []string{"/admin/", "/admin/status.json", "/admin/metrics"} {
 		req, err := http.NewRequest("GET", path, nil)
 		if err != nil {
 			t.Fatal(err)
@@ -83,3 +90,182 @@ func TestAdminDisableEndpoints(t *testing.T) {
 		}
 	}
 }
+
+// polling the status while messages are being broadcast and written out should
+// be free of data races, run with -race
+func TestAdminStatusDuringBroadcast(t *testing.T) {
+	s := NewServer()
+	s.Options.Shards = 2
+	s.Options.SlowConsumerPolicy = SlowConsumerDropOldest // keep everyone connected
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	defer s.hub.Shutdown()
+
+	const numConns, numMsgs = 4, 2000
+	for i := 0; i < numConns; i++ {
+		res := subscribe(t, ts, "/pets")
+		defer res.Body.Close()
+		go io.Copy(ioutil.Discard, res.Body)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				res, err := http.Get(ts.URL + "/admin/status.json")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var status ReportingStatus
+				err = json.NewDecoder(res.Body).Decode(&status)
+				res.Body.Close()
+				if err != nil {
+					t.Error("error decoding status:", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < numMsgs; i++ {
+		s.Broadcast <- SSEMessage{Data: []byte("woof"), Namespace: "/pets"}
+	}
+	close(done)
+	wg.Wait()
+
+	status := s.Status()
+	if status.SentMsgs != numMsgs {
+		t.Errorf("unexpected msgs_broadcast: got %d want %d", status.SentMsgs, numMsgs)
+	}
+	if len(status.Connections) != numConns {
+		t.Errorf("unexpected num of connections: got %d want %d", len(status.Connections), numConns)
+	}
+}
+
+// it should be possible to inspect and kick a single connection by its ID
+func TestAdminConnection(t *testing.T) {
+	s := NewServer()
+	events := recordHooks(&s.Options)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	defer s.hub.Shutdown()
+
+	res := subscribe(t, ts, "/pets")
+	defer res.Body.Close()
+	other := subscribe(t, ts, "/cats")
+	defer other.Body.Close()
+	nextHook(t, events)
+	nextHook(t, events)
+	var id uint64
+	for _, c := range s.Status().Connections {
+		if c.Namespace == "/pets" {
+			id = c.ID
+		}
+	}
+
+	get, err := http.Get(fmt.Sprintf("%s/admin/connections/%d", ts.URL, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st connectionStatus
+	err = json.NewDecoder(get.Body).Decode(&st)
+	get.Body.Close()
+	if err != nil {
+		t.Fatal("error decoding status:", err)
+	}
+	if st.ID != id || st.Namespace != "/pets" {
+		t.Errorf("unexpected connection status: %+v", st)
+	}
+
+	kickURL := fmt.Sprintf("%s/admin/connections/%d/kick", ts.URL, id)
+	kickWith := func(key string, header http.Header) *http.Response {
+		t.Helper()
+		form := url.Values{"reason": {"be nice"}}
+		req, _ := http.NewRequest("POST", kickURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// kicking is disabled by default, and then refused unless authorized and
+	// from the same origin
+	if kick := kickWith("hunter2", nil); kick.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status kicking when disabled: got %v want %v", kick.StatusCode, http.StatusNotFound)
+	}
+	s.Options.AdminAuthorizer = testPublishAuthorizer
+	for _, tc := range []struct {
+		key    string
+		header http.Header
+		status int
+	}{
+		{"", nil, http.StatusUnauthorized},
+		{"nope", nil, http.StatusUnauthorized},
+		{"hunter2", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{"hunter2", http.Header{"Origin": {"null"}}, http.StatusForbidden},
+		{"hunter2", http.Header{"Sec-Fetch-Site": {"cross-site"}}, http.StatusForbidden},
+	} {
+		if kick := kickWith(tc.key, tc.header); kick.StatusCode != tc.status {
+			t.Errorf("unexpected status kicking with %q %v: got %v want %v", tc.key, tc.header, kick.StatusCode, tc.status)
+		}
+	}
+
+	kick := kickWith("hunter2", http.Header{
+		"Origin":         {ts.URL},
+		"Sec-Fetch-Site": {"same-origin"},
+	})
+	if kick.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected status kicking: got %v want %v", kick.StatusCode, http.StatusNoContent)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "event:disconnect\ndata:be nice\n\n"; string(body) != expected {
+		t.Errorf("unexpected farewell: got %q want %q", body, expected)
+	}
+	expected := hookEvent{hook: "disconnect", path: "/pets", reason: DisconnectKicked}
+	if e := nextHook(t, events); e != expected {
+		t.Errorf("unexpected hook: got %+v want %+v", e, expected)
+	}
+
+	// now it has gone, along with anyone never connected
+	for _, path := range []string{
+		fmt.Sprintf("/admin/connections/%d", id),
+		"/admin/connections/999",
+		"/admin/connections/nope",
+	} {
+		get, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		get.Body.Close()
+		if get.StatusCode != http.StatusNotFound {
+			t.Errorf("unexpected status for %s: got %v want %v", path, get.StatusCode, http.StatusNotFound)
+		}
+	}
+	if s.Kick(id, "") {
+		t.Error("kicked a connection which has already gone")
+	}
+	if n := len(s.Status().Connections); n != 1 {
+		t.Errorf("unexpected num of connections: got %d want 1", n)
+	}
+}
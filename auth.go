@@ -0,0 +1,119 @@
+package sseserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An Authorizer decides whether a request may subscribe to a namespace.
+//
+// It is called with the request once for each namespace requested, before the
+// connection is registered, so may read credentials from the request headers
+// or query parameters.
+type Authorizer interface {
+	Authorize(r *http.Request, namespace string) Authorization
+}
+
+// The AuthorizerFunc type is an adapter to allow the use of ordinary functions
+// as an Authorizer.
+type AuthorizerFunc func(r *http.Request, namespace string) Authorization
+
+// Authorize calls f(r, namespace).
+func (f AuthorizerFunc) Authorize(r *http.Request, namespace string) Authorization {
+	return f(r, namespace)
+}
+
+// Authorization is the decision of an Authorizer for a single namespace. The
+// zero value allows the subscription as requested.
+type Authorization struct {
+	// Deny refuses the whole request, responding with Status and Body.
+	Deny   bool
+	Status int    // defaults to 403 Forbidden
+	Body   string // defaults to the Status and its text, e.g. "403 forbidden"
+
+	// Namespace, if set, is subscribed to in place of the one requested, for
+	// example to narrow a request for "/users" to "/users/alice".
+	Namespace string
+	// Identity, if set, is attached to the connection, and is included in its
+	// ConnectionInfo and admin status. Where multiple namespaces are requested
+	// the first Identity given is used.
+	Identity string
+	// Events, if not nil, are the only event types the connection may
+	// receive, regardless of those it asks for. Where multiple namespaces are
+	// requested only events allowed by all of them are received.
+	Events []string
+	// Expires, if set, is when the connection will be disconnected, e.g. once
+	// the credentials it was authorized with lapse. Where multiple namespaces
+	// are requested the earliest is used.
+	Expires time.Time
+}
+
+// authorize runs the Authorizer, if set, for each of the namespaces requested,
+// returning the namespaces to subscribe to, and the Authorization for them all
+// combined, or otherwise the first which denied them.
+func authorize(a Authorizer, r *http.Request, namespaces []string) ([]string, Authorization) {
+	if a == nil {
+		return namespaces, Authorization{}
+	}
+	var (
+		combined Authorization
+		granted  = make([]string, 0, len(namespaces))
+		seen     = make(map[string]bool, len(namespaces))
+	)
+	for _, ns := range namespaces {
+		auth := a.Authorize(r, ns)
+		if auth.Deny {
+			return nil, auth
+		}
+		if auth.Namespace != "" {
+			ns = auth.Namespace
+		}
+		if combined.Identity == "" {
+			combined.Identity = auth.Identity
+		}
+		if auth.Events != nil {
+			combined.Events = intersectEvents(combined.Events, auth.Events)
+		}
+		if !auth.Expires.IsZero() && (combined.Expires.IsZero() || auth.Expires.Before(combined.Expires)) {
+			combined.Expires = auth.Expires
+		}
+		// narrowing may have made some the same
+		if !seen[ns] {
+			seen[ns] = true
+			granted = append(granted, ns)
+		}
+	}
+	return granted, combined
+}
+
+// intersectEvents returns the events in both a and b, where nil means any.
+func intersectEvents(a, b []string) []string {
+	if a == nil {
+		return b
+	}
+	both := []string{}
+	for _, e := range a {
+		for _, f := range b {
+			if e == f {
+				both = append(both, e)
+				break
+			}
+		}
+	}
+	return both
+}
+
+// deny writes the response for a denied Authorization.
+func (auth *Authorization) deny(w http.ResponseWriter) {
+	status := auth.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	body := auth.Body
+	if body == "" {
+		body = fmt.Sprintf("%d %s", status, strings.ToLower(http.StatusText(status)))
+	}
+	http.Error(w, body, status)
+}
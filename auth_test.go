@@ -0,0 +1,128 @@
+package sseserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a client may only read the private namespace of whoever they say they are,
+// and nobody may read /secret
+var testAuthorizer = AuthorizerFunc(func(r *http.Request, namespace string) Authorization {
+	user := r.Header.Get("X-User")
+	switch {
+	case user == "":
+		return Authorization{Deny: true}
+	case namespace == "/secret":
+		return Authorization{Deny: true, Status: http.StatusUnauthorized, Body: "no peeking"}
+	case namespace == "/users":
+		return Authorization{Namespace: "/users/" + user, Identity: user}
+	}
+	return Authorization{Identity: user}
+})
+
+func TestAuthorize(t *testing.T) {
+	r := httptest.NewRequest("GET", "/subscribe/users", nil)
+	r.Header.Set("X-User", "alice")
+
+	namespaces, auth := authorize(testAuthorizer, r, []string{"/users", "/pets", "/users/alice"})
+	if auth.Deny {
+		t.Fatalf("unexpectedly denied: %+v", auth)
+	}
+	if expected := []string{"/users/alice", "/pets"}; !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("unexpected namespaces: got %v want %v", namespaces, expected)
+	}
+	if auth.Identity != "alice" {
+		t.Errorf("unexpected identity: got %q want %q", auth.Identity, "alice")
+	}
+
+	if _, auth := authorize(testAuthorizer, r, []string{"/pets", "/secret"}); !auth.Deny {
+		t.Error("expected /secret to be denied")
+	}
+
+	namespaces, auth = authorize(nil, r, []string{"/secret"})
+	if auth.Deny || auth.Identity != "" || !reflect.DeepEqual(namespaces, []string{"/secret"}) {
+		t.Errorf("nil Authorizer should allow anything: got %v %+v", namespaces, auth)
+	}
+}
+
+func TestAuthorizeCombined(t *testing.T) {
+	soon, later := time.Now().Add(time.Minute), time.Now().Add(time.Hour)
+	grants := map[string]Authorization{
+		"/a": {Events: []string{"x", "y"}, Expires: later},
+		"/b": {},
+		"/c": {Events: []string{"y", "z"}, Expires: soon},
+	}
+	a := AuthorizerFunc(func(r *http.Request, namespace string) Authorization {
+		return grants[namespace]
+	})
+	r := httptest.NewRequest("GET", "/subscribe/a", nil)
+
+	_, auth := authorize(a, r, []string{"/a", "/b", "/c"})
+	if !reflect.DeepEqual(auth.Events, []string{"y"}) || !auth.Expires.Equal(soon) {
+		t.Errorf("unexpected combined authorization: %+v", auth)
+	}
+	_, auth = authorize(a, r, []string{"/b"})
+	if auth.Events != nil || !auth.Expires.IsZero() {
+		t.Errorf("unexpected restrictions: %+v", auth)
+	}
+}
+
+func TestAuthorizerSubscribe(t *testing.T) {
+	s := NewServer()
+	s.Options.Authorizer = testAuthorizer
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	defer s.hub.Shutdown()
+
+	for _, tc := range []struct {
+		user, namespace string
+		status          int
+		body            string
+	}{
+		{"", "/pets", http.StatusForbidden, "403 forbidden\n"},
+		{"bob", "/secret", http.StatusUnauthorized, "no peeking\n"},
+		{"bob", "/pets?ns=/secret", http.StatusUnauthorized, "no peeking\n"},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+"/subscribe"+tc.namespace, nil)
+		if tc.user != "" {
+			req.Header.Set("X-User", tc.user)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.status || string(body) != tc.body {
+			t.Errorf("%q subscribing to %s: got %v %q want %v %q",
+				tc.user, tc.namespace, res.StatusCode, body, tc.status, tc.body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/subscribe/users", nil)
+	req.Header.Set("X-User", "alice")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status subscribing: got %v want %v", res.StatusCode, http.StatusOK)
+	}
+
+	conns := s.Status().Connections
+	if len(conns) != 1 {
+		t.Fatalf("unexpected num of connections: got %d want 1", len(conns))
+	}
+	if c := conns[0]; c.Identity != "alice" || strings.Join(c.Namespaces, ",") != "/users/alice" {
+		t.Errorf("unexpected connection status: %+v", c)
+	}
+	if n := s.Presence("/users/bob"); n != 0 {
+		t.Errorf("alice should not be subscribed to bob: got presence %d", n)
+	}
+}
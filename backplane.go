@@ -0,0 +1,183 @@
+package sseserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// A Backplane connects multiple Servers (nodes), typically running on
+// different machines behind a load balancer, so that a message broadcast on
+// any one of them is delivered to subscribers on all of them.
+//
+// Every message broadcast on a node is delivered to its own subscribers
+// directly, and then published to the Backplane tagged with the NodeID of its
+// origin. Messages received from the Backplane are delivered to subscribers
+// but never published again, and any which originated on the receiving node
+// are ignored, so a Backplane which echoes messages back to their sender, or
+// delivers them to a node more than once via different routes, will not cause
+// duplicates or loops.
+//
+// Message IDs are assigned on the origin node only, so to allow clients to
+// resume on a different node after reconnecting, all nodes should have replay
+// enabled in the same way.
+type Backplane interface {
+	// Publish sends a message to the other nodes. It is called from the hub
+	// run loop, so must not block waiting on the network.
+	Publish(msg BackplaneMessage) error
+	// Messages returns the channel on which messages from other nodes are
+	// received, which should be closed once the Backplane is closed.
+	Messages() <-chan BackplaneMessage
+	// Close disconnects from the other nodes.
+	//
+	// A Server does not close its Backplane, as it may be shared, so this
+	// should be done after the Server has been Shutdown.
+	Close() error
+}
+
+// BackplaneMessage is a message passed between nodes via a Backplane.
+type BackplaneMessage struct {
+	Origin  string     `json:"origin"` // NodeID of the node it was broadcast on
+	Message SSEMessage `json:"msg"`
+}
+
+// BackplaneStatus describes the state of a Backplane's link to other nodes.
+type BackplaneStatus struct {
+	Type       string `json:"type"`
+	Connected  bool   `json:"connected"`
+	Reconnects uint64 `json:"reconnects"` // times the link was lost or failed to connect
+	Dropped    uint64 `json:"dropped"`    // msgs not published as the queue was full
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// A BackplaneStatusReporter is a Backplane which can report the state of its
+// link, which will be included in the ReportingStatus of the Server using it.
+type BackplaneStatusReporter interface {
+	Status() BackplaneStatus
+}
+
+// ErrBackplaneClosed is returned when publishing to a Backplane which has been
+// closed.
+var ErrBackplaneClosed = errors.New("sseserver: Backplane closed")
+
+// randomNodeID generates an ID for a node which has not been given one.
+func randomNodeID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic("sseserver: unable to generate node ID: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// LocalBus is an in-process Backplane, connecting Servers within the same
+// process to one another. It is mostly useful for testing.
+//
+// Like most pub/sub systems, messages are also delivered back to the node
+// which published them.
+type LocalBus struct {
+	mu      sync.Mutex
+	members map[*localMember]bool
+}
+
+// NewLocalBus creates a new LocalBus with no members.
+func NewLocalBus() *LocalBus {
+	return &LocalBus{members: make(map[*localMember]bool)}
+}
+
+// Join returns a new Backplane connected to the bus, to be set as the
+// Backplane of a Server.
+func (b *LocalBus) Join() Backplane {
+	m := &localMember{
+		bus:  b,
+		out:  make(chan BackplaneMessage),
+		quit: make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	b.mu.Lock()
+	b.members[m] = true
+	b.mu.Unlock()
+	go m.pump()
+	return m
+}
+
+// localMember is a single node's connection to a LocalBus.
+//
+// Messages are queued without limit, so that publishing never blocks on a
+// member which is busy publishing itself.
+type localMember struct {
+	bus  *LocalBus
+	out  chan BackplaneMessage
+	quit chan struct{}
+
+	mu     sync.Mutex // Guards queue and closed
+	cond   *sync.Cond
+	queue  []BackplaneMessage
+	closed bool
+}
+
+func (m *localMember) Publish(msg BackplaneMessage) error {
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		return ErrBackplaneClosed
+	}
+
+	m.bus.mu.Lock()
+	defer m.bus.mu.Unlock()
+	for other := range m.bus.members {
+		other.enqueue(msg)
+	}
+	return nil
+}
+
+func (m *localMember) Messages() <-chan BackplaneMessage {
+	return m.out
+}
+
+func (m *localMember) Close() error {
+	m.bus.mu.Lock()
+	delete(m.bus.members, m)
+	m.bus.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.quit)
+		m.cond.Signal()
+	}
+	return nil
+}
+
+func (m *localMember) enqueue(msg BackplaneMessage) {
+	m.mu.Lock()
+	m.queue = append(m.queue, msg)
+	m.mu.Unlock()
+	m.cond.Signal()
+}
+
+// pump passes queued messages on to the out chan, until closed.
+func (m *localMember) pump() {
+	defer close(m.out)
+	for {
+		m.mu.Lock()
+		for len(m.queue) == 0 && !m.closed {
+			m.cond.Wait()
+		}
+		if m.closed {
+			m.mu.Unlock()
+			return
+		}
+		msg := m.queue[0]
+		m.queue = m.queue[1:]
+		m.mu.Unlock()
+
+		select {
+		case m.out <- msg:
+		case <-m.quit:
+			return
+		}
+	}
+}
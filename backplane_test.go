@@ -0,0 +1,124 @@
+package sseserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// receive returns the next frame sent to a connection, failing if there is
+// none within a reasonable time.
+func receive(t *testing.T, c *connection) string {
+	t.Helper()
+	select {
+	case f := <-c.send:
+		return string(f.frame)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for msg")
+		return ""
+	}
+}
+
+// mockNodes creates a Server for each backplane, and registers a connection
+// subscribed to namespace on each.
+func mockNodes(namespace string, backplanes ...Backplane) ([]*Server, []*connection) {
+	var (
+		servers []*Server
+		conns   []*connection
+	)
+	for _, b := range backplanes {
+		s := NewServer()
+		s.Options.ReplayBufferSize = 10
+		s.Options.Backplane = b
+		c := mockConn(namespace)
+		s.hub.register <- c
+		servers = append(servers, s)
+		conns = append(conns, c)
+	}
+	return servers, conns
+}
+
+// a message broadcast on any node should be delivered exactly once to the
+// subscribers on every node, with the same ID everywhere.
+func TestBackplaneLocalBus(t *testing.T) {
+	bus := NewLocalBus()
+	servers, conns := mockNodes("/pets", bus.Join(), bus.Join())
+	a, b := servers[0], servers[1]
+	ca, cb := conns[0], conns[1]
+
+	// each broadcast is only received by the other node after its previous
+	// ones echoed back to it, so once the last message is received there
+	// should be nothing else left.
+	a.Broadcast <- SSEMessage{Data: []byte("1"), Namespace: "/pets"}
+	fa, fb := receive(t, ca), receive(t, cb)
+	if fa != fb {
+		t.Errorf("msg differs between nodes: %q vs %q", fa, fb)
+	}
+	b.Broadcast <- SSEMessage{Data: []byte("2"), Namespace: "/pets"}
+	fb, fa = receive(t, cb), receive(t, ca)
+	if fa != fb {
+		t.Errorf("msg differs between nodes: %q vs %q", fa, fb)
+	}
+	a.Broadcast <- SSEMessage{Data: []byte("3"), Namespace: "/pets/cats", ID: "meow"}
+	if f := receive(t, ca); f != "id:meow\ndata:3\n\n" {
+		t.Errorf("unexpected msg: got %q", f)
+	}
+	if f := receive(t, cb); f != "id:meow\ndata:3\n\n" {
+		t.Errorf("unexpected msg: got %q", f)
+	}
+
+	for i, s := range servers {
+		s.hub.Shutdown()
+		if extra := drain(conns[i]); len(extra) > 0 {
+			t.Errorf("node %d received unexpected msgs: %q", i, extra)
+		}
+	}
+	if status := a.Status(); status.SentMsgs != 3 {
+		t.Errorf("unexpected msgs_broadcast: got %d want %d", status.SentMsgs, 3)
+	}
+}
+
+// a node should not replay messages from the backplane to it, or reassign
+// their IDs, so that clients can resume from any node.
+func TestBackplaneReplay(t *testing.T) {
+	bus := NewLocalBus()
+	servers, conns := mockNodes("/pets", bus.Join(), bus.Join())
+	defer servers[0].hub.Shutdown()
+	defer servers[1].hub.Shutdown()
+
+	for _, d := range []string{"1", "2", "3"} {
+		servers[0].Broadcast <- SSEMessage{Data: []byte(d), Namespace: "/pets"}
+	}
+	var frames []string
+	for i := 0; i < 3; i++ {
+		frames = append(frames, receive(t, conns[1]))
+	}
+
+	// resume on the other node from the first msg
+	c := mockConn("/pets")
+	c.lastEventID = strings.TrimPrefix(strings.SplitN(frames[0], "\n", 2)[0], "id:")
+	servers[1].hub.register <- c
+	for _, expected := range frames[1:] {
+		if f := receive(t, c); f != expected {
+			t.Errorf("unexpected replayed msg: got %q want %q", f, expected)
+		}
+	}
+}
+
+func TestLocalBusClose(t *testing.T) {
+	bus := NewLocalBus()
+	b1, b2 := bus.Join(), bus.Join()
+	b1.Close()
+	if err := b1.Publish(BackplaneMessage{}); err != ErrBackplaneClosed {
+		t.Errorf("unexpected error: got %v want %v", err, ErrBackplaneClosed)
+	}
+	if _, ok := <-b1.Messages(); ok {
+		t.Error("expected Messages chan to be closed")
+	}
+	// remaining members should be unaffected
+	b2.Publish(BackplaneMessage{Origin: "b2"})
+	if bm := <-b2.Messages(); bm.Origin != "b2" {
+		t.Errorf("unexpected msg: got %+v", bm)
+	}
+	b2.Close()
+}
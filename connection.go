@@ -1,7 +1,10 @@
 package sseserver
 
 import (
+	"math/rand"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/azer/debug"
@@ -9,55 +12,122 @@ import (
 
 const connBufSize = 256
 
+// defaults for keepalives, see ServerOptions.KeepaliveInterval
+const (
+	keepaliveInterval = 15 * time.Second
+	keepalivePayload  = "keepalive"
+)
+
+// queuedMsg is a formatted message queued for sending to a connection.
+type queuedMsg struct {
+	frame []byte
+	at    time.Time // when it was broadcast, for measuring latency
+}
+
 type connection struct {
-	r         *http.Request       // The HTTP request
-	w         http.ResponseWriter // The HTTP response
-	created   time.Time           // Timestamp for when connection was opened
-	send      chan []byte         // Buffered channel of outbound messages
-	namespace string              // Conceptual "channel" SSE client is requesting
-	msgsSent  uint64              // Msgs the connection has sent (all time)
+	// accessed atomically, so kept first for 64-bit alignment on 32-bit platforms
+	msgsSent uint64 // Msgs the connection has sent (all time)
+
+	id           uint64              // Unique ID, assigned by hub on registration
+	identity     string              // Who the client is, from the Authorizer
+	expires      time.Time           // When the client's authorization lapses, if ever
+	keepalive    time.Duration       // How long to be idle before sending keepaliveMsg
+	keepaliveMsg []byte              // Formatted keepalive
+	r            *http.Request       // The HTTP request
+	w            http.ResponseWriter // The HTTP response
+	created      time.Time           // Timestamp for when connection was opened
+	send         chan queuedMsg      // Buffered channel of outbound messages
+	namespaces   []string            // Conceptual "channels" SSE client is requesting
+	events       eventFilter         // Event types SSE client is interested in
+	lastEventID  string              // Last-Event-ID the client is resuming from
+	shard        *shard              // Shard the connection belongs to, owned by hub
+	present      bool                // Counted towards presence, owned by hub
+	closeReason  DisconnectReason    // Why send was closed, set by shard before closing
+	stalledSince time.Time           // When send buffer became full, owned by shard
+	matchGen     uint64              // Last broadcast matched, owned by shard
+	metrics      *metrics            // Counters updated by writer, may be nil
 }
 
-func newConnection(w http.ResponseWriter, r *http.Request, namespace string) *connection {
+func newConnection(w http.ResponseWriter, r *http.Request, namespaces []string, bufSize int) *connection {
 	return &connection{
-		send:      make(chan []byte, connBufSize),
-		w:         w,
-		r:         r,
-		created:   time.Now(),
-		namespace: namespace,
+		send:       make(chan queuedMsg, bufSize),
+		w:          w,
+		r:          r,
+		created:    time.Now(),
+		namespaces: namespaces,
+		// the defaults, the handler will set these from the ServerOptions
+		keepalive:    keepaliveInterval,
+		keepaliveMsg: []byte(":" + keepalivePayload + "\n"),
+	}
+}
+
+// subscribedTo reports whether a message broadcast to namespace should be
+// delivered to the connection, via any of its subscriptions.
+func (c *connection) subscribedTo(namespace string) bool {
+	for _, sub := range c.namespaces {
+		if matchNamespace(sub, namespace) {
+			return true
+		}
 	}
+	return false
+}
+
+// wants reports whether a message broadcast to namespace with the given event
+// type should be delivered to the connection.
+func (c *connection) wants(namespace, event string) bool {
+	return c.subscribedTo(namespace) && c.events.allows(event)
+}
+
+// String returns the namespaces subscribed to, for logging.
+func (c *connection) String() string {
+	return strings.Join(c.namespaces, ",")
 }
 
 type connectionStatus struct {
-	Path      string `json:"request_path"`
-	Namespace string `json:"namespace"`
-	Created   int64  `json:"created_at"`
-	ClientIP  string `json:"client_ip"`
-	UserAgent string `json:"user_agent"`
-	MsgsSent  uint64 `json:"msgs_sent"`
+	ID         uint64   `json:"id"`
+	Identity   string   `json:"identity,omitempty"`
+	Path       string   `json:"request_path"`
+	Namespace  string   `json:"namespace"` // first of Namespaces
+	Namespaces []string `json:"namespaces"`
+	Created    int64    `json:"created_at"`
+	ClientIP   string   `json:"client_ip"`
+	UserAgent  string   `json:"user_agent"`
+	MsgsSent   uint64   `json:"msgs_sent"`
 }
 
 func (c *connection) Status() connectionStatus {
 	return connectionStatus{
-		Path:      c.r.URL.Path,
-		Namespace: c.namespace,
-		Created:   c.created.Unix(),
-		ClientIP:  c.r.RemoteAddr,
-		UserAgent: c.r.UserAgent(),
-		MsgsSent:  c.msgsSent,
+		ID:         c.id,
+		Identity:   c.identity,
+		Path:       c.r.URL.Path,
+		Namespace:  c.namespaces[0],
+		Namespaces: c.namespaces,
+		Created:    c.created.Unix(),
+		ClientIP:   c.r.RemoteAddr,
+		UserAgent:  c.r.UserAgent(),
+		MsgsSent:   atomic.LoadUint64(&c.msgsSent),
 	}
 }
 
 // writer is the event loop that attempts to send all messages on the active
 // http connection.  it will detect if the http connection is closed and autoexit.
 // it will also exit if the connection's send channel is closed (indicating a shutdown)
-func (c *connection) writer() {
-	// set up a keepalive tickle to prevent connections from being closed by a timeout
-	// any SSE line beginning with the colon will be ignored, so use that.
+// returns the reason it exited.
+func (c *connection) writer() DisconnectReason {
+	// set up a keepalive tickle to prevent connections from being closed by a
+	// timeout, when nothing else has been written for a while.
 	// https://www.w3.org/TR/eventsource/#event-stream-interpretation
-	keepaliveTickler := time.NewTicker(15 * time.Second)
-	keepaliveMsg := []byte(":keepalive\n")
-	defer keepaliveTickler.Stop()
+	keepaliveTimer := time.NewTimer(c.keepalive)
+	defer keepaliveTimer.Stop()
+	var lastWrite time.Time
+
+	// disconnect once the client's authorization lapses, if it does
+	var expired <-chan time.Time
+	if !c.expires.IsZero() {
+		expiry := time.NewTimer(time.Until(c.expires))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
 
 	for {
 		select {
@@ -65,55 +135,221 @@ func (c *connection) writer() {
 			if !ok { // chan was closed
 				// ...our hub told us we have nothing left to do
 				debug.Debug("hub told us to shut down")
-				return
+				return c.closeReason
 			}
 			// otherwise write message out to client
-			_, err := c.w.Write(msg)
+			n, err := c.w.Write(msg.frame)
 			if err != nil {
 				debug.Debug("Error writing msg to client, closing")
-				return
+				return DisconnectWriteError
 			}
 			if f, ok := c.w.(http.Flusher); ok {
 				f.Flush()
-				c.msgsSent++
+				atomic.AddUint64(&c.msgsSent, 1)
 			}
+			if c.metrics != nil {
+				c.metrics.wrote(msg, n)
+			}
+			lastWrite = time.Now()
 
-		case <-keepaliveTickler.C:
-			_, err := c.w.Write(keepaliveMsg)
+		case <-keepaliveTimer.C:
+			// rather than resetting the timer for every msg, check when it
+			// fires whether there has been one since
+			if idle := time.Since(lastWrite); idle < c.keepalive {
+				keepaliveTimer.Reset(c.keepalive - idle)
+				continue
+			}
+			n, err := c.w.Write(c.keepaliveMsg)
 			if err != nil {
 				debug.Debug("Error writing keepalive to client, closing")
-				return
+				return DisconnectWriteError
 			}
 			if f, ok := c.w.(http.Flusher); ok {
 				f.Flush()
 			}
+			if c.metrics != nil {
+				c.metrics.wroteKeepalive(n)
+			}
+			keepaliveTimer.Reset(c.keepalive)
+
+		case <-expired:
+			debug.Debug("authorization expired for conn")
+			return DisconnectExpired
 
 		case <-c.r.Context().Done():
 			debug.Debug("closer fired for conn")
-			return
+			return DisconnectClientClosed
 		}
 	}
 }
 
 func connectionHandler(h *hub) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.opts.cors().handle(w, r) {
+			return // OPTIONS, already answered
+		}
+		if !h.acquire() {
+			http.Error(w, "503 server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer h.release()
+
+		// check the client may subscribe to what it asked for, before anything
+		// is written so that it can be refused
+		namespaces, auth := authorize(h.opts.Authorizer, r, requestNamespaces(r))
+		if auth.Deny {
+			auth.deny(w)
+			return
+		}
+
 		// write headers
 		headers := w.Header()
-		headers.Set("Access-Control-Allow-Origin", "*") // TODO: make optional
 		headers.Set("Content-Type", "text/event-stream; charset=utf-8")
 		headers.Set("Cache-Control", "no-cache")
 		headers.Set("Connection", "keep-alive")
 		headers.Set("Server", "mroth/sseserver")
 
-		// get namespace from URL path, init connection & register with hub
-		namespace := r.URL.Path
-		c := newConnection(w, r, namespace)
-		h.register <- c
+		// init connection & register with hub
+		c := newConnection(w, r, namespaces, h.opts.connBufferSize())
+		c.identity = auth.Identity
+		c.expires = auth.Expires
+		c.events = requestEventFilter(r)
+		c.events.permit = auth.Events
+		c.keepalive, c.keepaliveMsg = h.opts.keepalive(namespaces)
+		c.metrics = h.metrics
+		// a reconnecting EventSource will tell us the last message it saw, so
+		// the hub can replay anything it missed in the meantime
+		c.lastEventID = r.Header.Get("Last-Event-ID")
+
+		// tell the client how long to wait before reconnecting, this goes out
+		// before we register so it precedes any messages from the hub
+		if retry := retryInterval(h.opts); retry > 0 {
+			w.Write(SSEMessage{Retry: retry}.sseFormat())
+		}
+
+		// if the hub has exited there is nobody left to talk to
+		select {
+		case h.register <- c:
+		case <-h.done:
+			return
+		}
+		reason := DisconnectClientClosed
 		defer func() {
-			h.unregister <- c
+			select {
+			case h.unregister <- c:
+			case <-h.done:
+			}
+			h.onDisconnect(c, reason)
 		}()
 
+		// send headers now rather than waiting for the first message, so the
+		// client knows its subscription is open
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
 		// start the connection's main broadcasting event loop
-		c.writer()
+		reason = c.writer()
 	})
 }
+
+// requestNamespaces returns the namespaces a request is subscribing to.
+//
+// Normally this is the URL path, but additional namespaces may be specified via
+// (possibly repeated) "ns" query parameters, allowing a single connection to
+// subscribe to several, e.g. "/subscribe?ns=/pets/cats&ns=/time". In that case
+// a root path is ignored, as it would make the others redundant.
+func requestNamespaces(r *http.Request) []string {
+	var namespaces []string
+	params := r.URL.Query()["ns"]
+	if path := r.URL.Path; len(params) == 0 || (path != "" && path != "/") {
+		namespaces = append(namespaces, path)
+	}
+	for _, ns := range params {
+		if !strings.HasPrefix(ns, "/") {
+			ns = "/" + ns
+		}
+		namespaces = append(namespaces, ns)
+	}
+
+	// dedupe, in place
+	seen := make(map[string]bool, len(namespaces))
+	uniq := namespaces[:0]
+	for _, ns := range namespaces {
+		if ns == "" {
+			ns = "/"
+		}
+		if !seen[ns] {
+			seen[ns] = true
+			uniq = append(uniq, ns)
+		}
+	}
+	return uniq
+}
+
+// eventFilter restricts the event types delivered to a connection. The zero
+// value allows everything.
+type eventFilter struct {
+	include []string // if non-empty, only these events are allowed
+	exclude []string // these events are never allowed
+	permit  []string // if not nil, no other events are allowed, see Authorization
+}
+
+// allows reports whether a message of the given event type passes the filter.
+// Per the spec, a message with no event type is a "message" event.
+func (f eventFilter) allows(event string) bool {
+	if event == "" {
+		event = "message"
+	}
+	if eventIn(event, f.exclude) {
+		return false
+	}
+	if f.permit != nil && !eventIn(event, f.permit) {
+		return false
+	}
+	return len(f.include) == 0 || eventIn(event, f.include)
+}
+
+func eventIn(event string, events []string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// requestEventFilter returns the eventFilter for a request, specified as comma
+// separated "events" (to only receive those) and/or "exclude_events" (to not
+// receive those) query parameters, e.g. "/subscribe/pets?events=new-dog,adopted".
+func requestEventFilter(r *http.Request) eventFilter {
+	query := r.URL.Query()
+	return eventFilter{
+		include: splitParams(query["events"]),
+		exclude: splitParams(query["exclude_events"]),
+	}
+}
+
+// splitParams splits each of a set of comma separated query param values
+// and returns all the non-empty results.
+func splitParams(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+// retryInterval returns the retry instruction to send a new connection, with
+// random jitter applied, or zero if none is configured.
+func retryInterval(opts *ServerOptions) time.Duration {
+	retry := opts.RetryInterval
+	if retry > 0 && opts.RetryJitter > 0 {
+		retry += time.Duration(rand.Int63n(int64(opts.RetryJitter)))
+	}
+	return retry
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -65,6 +66,99 @@ func TestConnectionHandler(t *testing.T) {
 
 }
 
+/*
+When configured, new connections should be told how long to wait before
+reconnecting, prior to anything else.
+*/
+func TestConnectionRetry(t *testing.T) {
+	h := newHub()
+	h.opts.RetryInterval = 5 * time.Second
+	h.Start()
+	defer h.Shutdown()
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Millisecond)
+	defer cancel()
+	connectionHandler(h).ServeHTTP(rr, req.WithContext(ctx))
+
+	expected := "retry:5000\n\n"
+	if actual := rr.Body.String(); actual != expected {
+		t.Errorf("body does not match: got %q want %q", actual, expected)
+	}
+}
+
+func TestRetryIntervalJitter(t *testing.T) {
+	opts := &ServerOptions{RetryInterval: time.Second, RetryJitter: time.Second}
+	for i := 0; i < 100; i++ {
+		if r := retryInterval(opts); r < time.Second || r >= 2*time.Second {
+			t.Fatalf("retry interval %v outside of jitter range", r)
+		}
+	}
+	if r := retryInterval(&ServerOptions{RetryJitter: time.Second}); r != 0 {
+		t.Errorf("expected no retry without an interval, got %v", r)
+	}
+}
+
+func TestRequestNamespaces(t *testing.T) {
+	var nsTests = []struct {
+		url      string
+		expected []string
+	}{
+		{"/pets", []string{"/pets"}},
+		{"/", []string{"/"}},
+		{"", []string{"/"}},
+		{"?ns=/pets/cats&ns=/time", []string{"/pets/cats", "/time"}},
+		{"/?ns=/pets/cats&ns=time", []string{"/pets/cats", "/time"}},
+		{"/pets?ns=/time", []string{"/pets", "/time"}},
+		{"/pets?ns=/pets&ns=/time&ns=/time", []string{"/pets", "/time"}},
+	}
+	for _, nt := range nsTests {
+		req, err := http.NewRequest("GET", nt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := requestNamespaces(req)
+		if strings.Join(actual, " ") != strings.Join(nt.expected, " ") {
+			t.Errorf("%q: got %q want %q", nt.url, actual, nt.expected)
+		}
+	}
+}
+
+func TestRequestEventFilter(t *testing.T) {
+	var filterTests = []struct {
+		url     string
+		allowed []string
+		denied  []string
+	}{
+		{"/pets", []string{"", "new-dog", "adopted"}, nil},
+		{"/pets?events=new-dog,adopted", []string{"new-dog", "adopted"}, []string{"", "new-cat"}},
+		{"/pets?events=new-dog&events=message", []string{"new-dog", ""}, []string{"adopted"}},
+		{"/pets?exclude_events=new-cat", []string{"", "new-dog"}, []string{"new-cat"}},
+		{"/pets?events=new-dog,new-cat&exclude_events=new-cat", []string{"new-dog"}, []string{"new-cat"}},
+	}
+	for _, ft := range filterTests {
+		req, err := http.NewRequest("GET", ft.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := requestEventFilter(req)
+		for _, e := range ft.allowed {
+			if !f.allows(e) {
+				t.Errorf("%q: expected event %q to be allowed", ft.url, e)
+			}
+		}
+		for _, e := range ft.denied {
+			if f.allows(e) {
+				t.Errorf("%q: expected event %q to be denied", ft.url, e)
+			}
+		}
+	}
+}
+
 /*
 Connection receives broadcast messages to its send channel.
 */
@@ -73,14 +167,14 @@ func TestConnectionSend(t *testing.T) {
 	// if able to move [r,w] out of connection wont need these...
 	req, _ := http.NewRequest("GET", "/", nil)
 	rr := httptest.NewRecorder()
-	c := newConnection(rr, req, "butts")
+	c := newConnection(rr, req, []string{"butts"}, connBufSize)
 
 	// async send a sse msg 2x then close
 	msg := SSEMessage{Event: "foo", Data: []byte("bar")}
 	payload := msg.sseFormat()
 	go func() {
-		c.send <- payload
-		c.send <- payload
+		c.send <- queuedMsg{frame: payload}
+		c.send <- queuedMsg{frame: payload}
 		close(c.send)
 	}()
 
@@ -100,3 +194,76 @@ buffer fills up.
 
 Add a test for this on the connection side (tested on hub side already).
 */
+
+// keepalive options should be resolved for the namespaces a connection is
+// subscribed to
+func TestKeepaliveOptions(t *testing.T) {
+	opts := ServerOptions{
+		KeepaliveInterval: 10 * time.Second,
+		Namespaces: map[string]NamespaceOptions{
+			"/mobile": {KeepaliveInterval: time.Minute, KeepalivePayload: "zzz"},
+			"/lb":     {KeepaliveInterval: 5 * time.Second},
+		},
+	}
+	for _, tc := range []struct {
+		namespaces []string
+		interval   time.Duration
+		frame      string
+	}{
+		{[]string{"/pets"}, 10 * time.Second, ":keepalive\n"},
+		{[]string{"/mobile/app"}, time.Minute, ":zzz\n"},
+		{[]string{"/mobile", "/lb"}, 5 * time.Second, ":zzz\n"},
+		{[]string{"/mobile", "/pets"}, 10 * time.Second, ":zzz\n"},
+	} {
+		interval, frame := opts.keepalive(tc.namespaces)
+		if interval != tc.interval || string(frame) != tc.frame {
+			t.Errorf("%v: got %v %q want %v %q", tc.namespaces, interval, frame, tc.interval, tc.frame)
+		}
+	}
+
+	interval, frame := (&ServerOptions{}).keepalive([]string{"/"})
+	if interval != 15*time.Second || string(frame) != ":keepalive\n" {
+		t.Errorf("unexpected defaults: got %v %q", interval, frame)
+	}
+
+	opts = ServerOptions{KeepaliveEvent: "ping", KeepalivePayload: "still\nhere"}
+	if _, frame := opts.keepalive([]string{"/"}); string(frame) != "event:ping\ndata:still\ndata:here\n\n" {
+		t.Errorf("unexpected keepalive event: got %q", frame)
+	}
+	opts.KeepaliveEvent = ""
+	if _, frame := opts.keepalive([]string{"/"}); string(frame) != ":still\n:here\n" {
+		t.Errorf("unexpected keepalive comment: got %q", frame)
+	}
+}
+
+/*
+Keepalives should only be sent while the connection is otherwise idle.
+*/
+func TestConnectionKeepalive(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	c := newConnection(rr, req, []string{"/pets"}, connBufSize)
+	c.keepalive = 100 * time.Millisecond
+	c.keepaliveMsg = []byte(":ka\n")
+
+	payload := SSEMessage{Data: []byte("woof")}.sseFormat()
+	go func() {
+		// busy for a few keepalive intervals, then idle for a couple
+		for start := time.Now(); time.Since(start) < 350*time.Millisecond; {
+			c.send <- queuedMsg{frame: payload}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(250 * time.Millisecond)
+		close(c.send)
+	}()
+	c.writer()
+
+	body := rr.Body.String()
+	first := strings.Index(body, ":ka\n")
+	if first == -1 {
+		t.Fatal("no keepalive sent while idle")
+	}
+	if strings.Contains(body[first:], "data:woof") {
+		t.Error("keepalive sent while msgs were being written")
+	}
+}
@@ -0,0 +1,110 @@
+package sseserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions configures Cross-Origin Resource Sharing for the subscribe
+// endpoint, determining which web pages on other origins may subscribe.
+type CORSOptions struct {
+	// AllowedOrigins are the origins which may subscribe, such as
+	// "https://example.com", or "*" to allow any. With AllowCredentials, "*"
+	// is ignored, and origins must be listed or allowed by AllowOrigin.
+	AllowedOrigins []string
+	// AllowOrigin, if set, is called to decide whether an origin may
+	// subscribe, in addition to those in AllowedOrigins.
+	AllowOrigin func(origin string) bool
+	// AllowCredentials allows pages to send cookies and other credentials,
+	// e.g. with EventSource's withCredentials.
+	AllowCredentials bool
+	// AllowedHeaders are the request headers which clients may send, e.g.
+	// "Authorization". If nil, any headers are allowed.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers which pages may read.
+	ExposedHeaders []string
+	// MaxAge is how long browsers may cache the result of a preflight request.
+	MaxAge time.Duration
+}
+
+// defaultCORS allows any origin, without credentials.
+var defaultCORS = &CORSOptions{AllowedOrigins: []string{"*"}}
+
+// cors returns the CORSOptions to use, which defaults to allowing any origin.
+func (o *ServerOptions) cors() *CORSOptions {
+	if o.CORS != nil {
+		return o.CORS
+	}
+	return defaultCORS
+}
+
+func (o *CORSOptions) allowsAnyOrigin() bool {
+	for _, allowed := range o.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOrigin reports whether origin is allowed explicitly, so may be sent
+// credentials, rather than by "*".
+func (o *CORSOptions) allowsOrigin(origin string) bool {
+	for _, allowed := range o.AllowedOrigins {
+		if allowed == origin {
+			return true
+		}
+	}
+	return o.AllowOrigin != nil && o.AllowOrigin(origin)
+}
+
+// handle sets the CORS headers for a request, and responds to it if it is an
+// OPTIONS request, including a CORS preflight, in which case it returns true
+// and there is nothing left to do.
+func (o *CORSOptions) handle(w http.ResponseWriter, r *http.Request) bool {
+	headers := w.Header()
+	origin := r.Header.Get("Origin")
+	allowed := true
+	switch {
+	case o.allowsAnyOrigin() && !o.AllowCredentials:
+		headers.Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && o.allowsOrigin(origin):
+		// the response now depends on who is asking, so must not be cached
+		// for anyone else
+		headers.Add("Vary", "Origin")
+		headers.Set("Access-Control-Allow-Origin", origin)
+		if o.AllowCredentials {
+			headers.Set("Access-Control-Allow-Credentials", "true")
+		}
+	default:
+		if origin != "" {
+			headers.Add("Vary", "Origin")
+		}
+		allowed = false // so say nothing more
+	}
+
+	if r.Method != http.MethodOptions {
+		if allowed && len(o.ExposedHeaders) > 0 {
+			headers.Set("Access-Control-Expose-Headers", strings.Join(o.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	headers.Set("Allow", "GET, OPTIONS")
+	if allowed && r.Header.Get("Access-Control-Request-Method") != "" {
+		headers.Set("Access-Control-Allow-Methods", "GET")
+		if o.AllowedHeaders != nil {
+			headers.Set("Access-Control-Allow-Headers", strings.Join(o.AllowedHeaders, ", "))
+		} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			headers.Add("Vary", "Access-Control-Request-Headers")
+			headers.Set("Access-Control-Allow-Headers", requested)
+		}
+		if o.MaxAge > 0 {
+			headers.Set("Access-Control-Max-Age", strconv.Itoa(int(o.MaxAge/time.Second)))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
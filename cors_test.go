@@ -0,0 +1,127 @@
+package sseserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	private := &CORSOptions{
+		AllowedOrigins:   []string{"https://example.com"},
+		AllowOrigin:      func(origin string) bool { return strings.HasSuffix(origin, ".example.com") },
+		AllowCredentials: true,
+		ExposedHeaders:   []string{"X-Node"},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		opts    *CORSOptions
+		origin  string
+		headers map[string]string // expected, "" for absent
+	}{
+		{"default without origin", defaultCORS, "", map[string]string{
+			"Access-Control-Allow-Origin": "*",
+			"Vary":                        "",
+		}},
+		{"default", defaultCORS, "https://evil.com", map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "",
+		}},
+		{"listed origin", private, "https://example.com", map[string]string{
+			"Access-Control-Allow-Origin":      "https://example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Expose-Headers":    "X-Node",
+			"Vary":                             "Origin",
+		}},
+		{"matched origin", private, "https://www.example.com", map[string]string{
+			"Access-Control-Allow-Origin": "https://www.example.com",
+		}},
+		{"disallowed origin", private, "https://evil.com", map[string]string{
+			"Access-Control-Allow-Origin":      "",
+			"Access-Control-Allow-Credentials": "",
+			"Access-Control-Expose-Headers":    "",
+			"Vary":                             "Origin",
+		}},
+		{"any origin with credentials", &CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			"https://evil.com", map[string]string{
+				"Access-Control-Allow-Origin":      "",
+				"Access-Control-Allow-Credentials": "",
+				"Vary":                             "Origin",
+			}},
+	} {
+		req := httptest.NewRequest("GET", "/pets", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		rr := httptest.NewRecorder()
+		if tc.opts.handle(rr, req) {
+			t.Errorf("%s: GET handled as preflight", tc.name)
+		}
+		for header, expected := range tc.headers {
+			if actual := rr.Header().Get(header); actual != expected {
+				t.Errorf("%s: %s header does not match: got %q want %q", tc.name, header, actual, expected)
+			}
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := newHub()
+	h.opts.CORS = &CORSOptions{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedHeaders: []string{"Authorization", "Last-Event-ID"},
+		MaxAge:         10 * time.Minute,
+	}
+	h.Start()
+	defer h.Shutdown()
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "/pets", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "authorization")
+		// should be answered immediately rather than opening a stream, so
+		// give up quickly if it does
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+		rr := httptest.NewRecorder()
+		connectionHandler(h).ServeHTTP(rr, req.WithContext(ctx))
+		return rr
+	}
+
+	rr := preflight("https://example.com")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("unexpected status: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+	for header, expected := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://example.com",
+		"Access-Control-Allow-Methods": "GET",
+		"Access-Control-Allow-Headers": "Authorization, Last-Event-ID",
+		"Access-Control-Max-Age":       "600",
+		"Content-Type":                 "",
+	} {
+		if actual := rr.Header().Get(header); actual != expected {
+			t.Errorf("%s header does not match: got %q want %q", header, actual, expected)
+		}
+	}
+
+	rr = preflight("https://evil.com")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("unexpected status: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+	for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Methods", "Access-Control-Allow-Headers"} {
+		if actual := rr.Header().Get(header); actual != "" {
+			t.Errorf("%s header should not be set for disallowed origin: got %q", header, actual)
+		}
+	}
+
+	// without a list, whatever headers are asked for are allowed
+	h.opts.CORS.AllowedHeaders = nil
+	if actual := preflight("https://example.com").Header().Get("Access-Control-Allow-Headers"); actual != "authorization" {
+		t.Errorf("unexpected Access-Control-Allow-Headers: got %q want %q", actual, "authorization")
+	}
+}
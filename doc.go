@@ -12,8 +12,13 @@ For more information on the SSE format itself, check out this fairly
 comprehensive article:
 http://www.html5rocks.com/en/tutorials/eventsource/basics/
 
-Note that the implementation of SSE in this server intentionally does not
-implement message IDs.
+Message IDs are optional. When ServerOptions.ReplayBufferSize is set, the
+server keeps a bounded history of recent messages for each namespace and assigns
+an ID to any message broadcast without one. Clients that reconnect with a
+Last-Event-ID header (which EventSource does automatically) are then sent the
+messages they missed, across all namespaces matching their subscription, before
+resuming the live stream. Setting ServerOptions.Journal instead keeps the history
+on disk, so that clients can still resume after the server restarts.
 
 
 Namespacing
@@ -32,5 +37,32 @@ to the "parent" endpoint would receive all messages broadcast to all child
 namespaces as well. E.g. in the previous example, a subscription to "/pets"
 would receive all messages broadcast to both the dogs and cats namespaces as
 well.
+
+Namespaces are matched on whole "/" separated segments, so "/pet" would not
+receive messages for "/pets" or "/petstore". A subscription may also use
+wildcard segments, where "*" matches exactly one segment and "**" matches any
+number of them:
+
+    HTTP GET /subscribe/pets/*     // "/pets/cats", "/pets/dogs", but not "/pets"
+    HTTP GET /subscribe/pets/**    // "/pets" and anything beneath it
+
+Wildcards may appear anywhere in a subscription, not only at the end.
+
+A single connection can subscribe to multiple namespaces at once by passing them
+as "ns" query parameters, which avoids running into browser limits on the number
+of concurrent connections. A message matching more than one of them is only
+delivered once:
+
+    HTTP GET /subscribe?ns=/pets/cats&ns=/time
+
+
+Event Filtering
+
+Clients can ask to only be sent certain event types with a comma separated
+"events" query parameter, or to not be sent some with "exclude_events". Messages
+without an event type are considered "message" events, as per the spec.
+
+    HTTP GET /subscribe/pets?events=new-dog,adopted
+    HTTP GET /subscribe/pets?exclude_events=message
 */
 package sseserver
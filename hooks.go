@@ -0,0 +1,129 @@
+package sseserver
+
+import (
+	"sync"
+	"time"
+)
+
+// DisconnectReason describes why a connection ended.
+type DisconnectReason int
+
+const (
+	// DisconnectClientClosed means the client went away.
+	DisconnectClientClosed DisconnectReason = iota
+	// DisconnectWriteError means writing to the client failed.
+	DisconnectWriteError
+	// DisconnectBufferFull means the client could not keep up, and was
+	// disconnected by the SlowConsumerPolicy.
+	DisconnectBufferFull
+	// DisconnectShutdown means the Server was shutdown.
+	DisconnectShutdown
+	// DisconnectKicked means the connection was deliberately closed by the
+	// server.
+	DisconnectKicked
+	// DisconnectExpired means the Authorization of the connection expired.
+	DisconnectExpired
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectClientClosed:
+		return "client-closed"
+	case DisconnectWriteError:
+		return "write-error"
+	case DisconnectBufferFull:
+		return "buffer-full"
+	case DisconnectShutdown:
+		return "shutdown"
+	case DisconnectKicked:
+		return "kicked"
+	case DisconnectExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// ConnectionInfo describes a connection, for the hooks in ServerOptions.
+type ConnectionInfo struct {
+	ID         uint64    // unique to the connection, see Server.Kick
+	Identity   string    // who the client is, see Authorization
+	Path       string    // the HTTP request path
+	Namespaces []string  // the namespaces subscribed to
+	Created    time.Time // when the connection was opened
+	RemoteAddr string
+	UserAgent  string
+}
+
+func (c *connection) info() ConnectionInfo {
+	return ConnectionInfo{
+		ID:         c.id,
+		Identity:   c.identity,
+		Path:       c.r.URL.Path,
+		Namespaces: c.namespaces,
+		Created:    c.created,
+		RemoteAddr: c.r.RemoteAddr,
+		UserAgent:  c.r.UserAgent(),
+	}
+}
+
+// hookDispatcher runs hooks in order, in a goroutine of its own so that a slow
+// hook cannot hold up the caller. The goroutine exits while there is nothing to
+// run.
+type hookDispatcher struct {
+	mu      sync.Mutex
+	queue   []func()
+	running bool
+}
+
+// dispatch queues fn to be run after any previously dispatched.
+func (d *hookDispatcher) dispatch(fn func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queue = append(d.queue, fn)
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+}
+
+func (d *hookDispatcher) run() {
+	for {
+		d.mu.Lock()
+		if len(d.queue) == 0 {
+			d.running = false
+			d.mu.Unlock()
+			return
+		}
+		fn := d.queue[0]
+		d.queue[0] = nil
+		d.queue = d.queue[1:]
+		d.mu.Unlock()
+		fn()
+	}
+}
+
+// onConnect runs the OnConnect hook, if set, for a newly registered connection.
+func (h *hub) onConnect(c *connection) {
+	if fn := h.opts.OnConnect; fn != nil {
+		info := c.info()
+		h.hooks.dispatch(func() { fn(info) })
+	}
+}
+
+// onDisconnect runs the OnDisconnect hook, if set, for a connection which has
+// ended.
+func (h *hub) onDisconnect(c *connection, reason DisconnectReason) {
+	if fn := h.opts.OnDisconnect; fn != nil {
+		info := c.info()
+		h.hooks.dispatch(func() { fn(info, reason) })
+	}
+}
+
+// onDrop runs the OnDrop hook, if set, for a formatted message discarded by
+// the given SlowConsumerPolicy rather than being sent to a connection.
+func (sh *shard) onDrop(c *connection, policy SlowConsumerPolicy, frame []byte) {
+	if fn := sh.opts.OnDrop; fn != nil {
+		info := c.info()
+		sh.hooks.dispatch(func() { fn(info, policy, frame) })
+	}
+}
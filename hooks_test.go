@@ -0,0 +1,120 @@
+package sseserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type hookEvent struct {
+	hook   string
+	path   string
+	reason DisconnectReason
+}
+
+func recordHooks(opts *ServerOptions) <-chan hookEvent {
+	events := make(chan hookEvent, 10)
+	opts.OnConnect = func(conn ConnectionInfo) {
+		events <- hookEvent{hook: "connect", path: conn.Path}
+	}
+	opts.OnDisconnect = func(conn ConnectionInfo, reason DisconnectReason) {
+		events <- hookEvent{hook: "disconnect", path: conn.Path, reason: reason}
+	}
+	return events
+}
+
+func nextHook(t *testing.T, events <-chan hookEvent) hookEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for hook")
+		return hookEvent{}
+	}
+}
+
+func TestHooksConnectDisconnect(t *testing.T) {
+	s := NewServer()
+	events := recordHooks(&s.Options)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", ts.URL+"/subscribe/pets", nil)
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := nextHook(t, events); e != (hookEvent{hook: "connect", path: "/pets"}) {
+		t.Errorf("unexpected hook: got %+v", e)
+	}
+	cancel()
+	res.Body.Close()
+	expected := hookEvent{hook: "disconnect", path: "/pets", reason: DisconnectClientClosed}
+	if e := nextHook(t, events); e != expected {
+		t.Errorf("unexpected hook: got %+v want %+v", e, expected)
+	}
+
+	// server goes away
+	res = subscribe(t, ts, "/cats")
+	defer res.Body.Close()
+	nextHook(t, events)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected = hookEvent{hook: "disconnect", path: "/cats", reason: DisconnectShutdown}
+	if e := nextHook(t, events); e != expected {
+		t.Errorf("unexpected hook: got %+v want %+v", e, expected)
+	}
+}
+
+func TestHooksDrop(t *testing.T) {
+	h := mockHub(0)
+	h.opts.SlowConsumerPolicy = SlowConsumerDropNewest
+	dropped := make(chan string, 10)
+	h.opts.OnDrop = func(conn ConnectionInfo, policy SlowConsumerPolicy, frame []byte) {
+		dropped <- policy.String() + " " + string(frame)
+	}
+	c := mockFullConn("/pets", h)
+	h.broadcast <- SSEMessage{Data: []byte("woof"), Namespace: "/pets"}
+	if d := <-dropped; d != "drop-newest data:woof\n\n" {
+		t.Errorf("unexpected drop: got %q", d)
+	}
+
+	// disconnecting should not be considered dropping
+	h.opts.SlowConsumerPolicy = SlowConsumerDisconnect
+	h.broadcast <- SSEMessage{Data: []byte("meow"), Namespace: "/pets"}
+	h.Shutdown()
+	if c.closeReason != DisconnectBufferFull {
+		t.Errorf("unexpected close reason: got %v want %v", c.closeReason, DisconnectBufferFull)
+	}
+	select {
+	case d := <-dropped:
+		t.Errorf("unexpected drop: %q", d)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// hooks should be run in order, without the slow ones holding up the caller
+func TestHookDispatcher(t *testing.T) {
+	var d hookDispatcher
+	unblock := make(chan struct{})
+	ran := make(chan int, 3)
+	d.dispatch(func() { <-unblock; ran <- 1 })
+	d.dispatch(func() { ran <- 2 })
+	d.dispatch(func() { ran <- 3 })
+	close(unblock)
+
+	var order []int
+	for i := 0; i < 3; i++ {
+		order = append(order, <-ran)
+	}
+	if !reflect.DeepEqual(order, []int{1, 2, 3}) {
+		t.Errorf("hooks ran out of order: %v", order)
+	}
+}
@@ -2,7 +2,8 @@ package sseserver
 
 import (
 	"fmt"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/azer/debug"
@@ -12,37 +13,215 @@ import (
 // broadcasting messages out to those connections that match the appropriate
 // namespace.
 //
+// The connections themselves are spread across one or more shards, each of
+// which handles the delivery of messages to its connections in its own
+// goroutine. The hub run loop assigns connections to shards, and does the work
+// common to all shards for each message before handing it off to them.
+//
 // The hub is effectively the "heart" of a Server, but is kept private to hide
 // implementation detais.
 type hub struct {
-	broadcast   chan SSEMessage      // Inbound messages to propagate out.
-	connections map[*connection]bool // Registered connections.
-	register    chan *connection     // Register requests from the connections.
-	unregister  chan *connection     // Unregister requests from connections.
-	shutdown    chan bool            // Internal chan to handle shutdown notification
-	sentMsgs    uint64               // Msgs broadcast since startup
-	startupTime time.Time            // Time hub was created
+	broadcast     chan SSEMessage         // Inbound messages to propagate out.
+	publish       chan publishRequest     // Inbound messages awaiting a DeliveryReport.
+	register      chan *connection        // Register requests from the connections.
+	unregister    chan *connection        // Unregister requests from connections.
+	query         chan *shardQuery        // Requests to inspect the shards.
+	shutdown      chan bool               // Internal chan to handle shutdown notification
+	done          chan struct{}           // Closed once the run loop has exited
+	shards        []*shard                // Started on first use, see _start
+	nextShard     int                     // Shard the next new connection is assigned to
+	sentMsgs      uint64                  // Msgs broadcast since startup
+	startupTime   time.Time               // Time hub was created
+	opts          *ServerOptions          // User options, owned by the Server
+	replay        replayStore             // Msg history for Last-Event-ID resume, if enabled
+	retained      *retainedStore          // Latest retained msg for each namespace
+	hooks         *hookDispatcher         // Runs user hooks off the run loop
+	metrics       *metrics                // Counters updated by connection writers
+	presence      *presenceTracker        // Counts of connections per namespace
+	presenceFlush chan struct{}           // Time to send pending presence events
+	lastID        uint64                  // Most recent automatically assigned msg ID
+	lastConnID    uint64                  // Most recently assigned connection ID
+	conns         map[uint64]*connection  // Registered connections by ID
+	backplane     Backplane               // Connection to other nodes, if any
+	nodeID        string                  // Identifies us on the backplane
+	incoming      <-chan BackplaneMessage // Inbound messages from other nodes
+
+	mu       sync.Mutex     // Guards closing, and adding to handlers
+	closing  bool           // No longer accepting new connections
+	handlers sync.WaitGroup // Active connection handlers
 }
 
 func newHub() *hub {
+	now := time.Now()
 	return &hub{
-		broadcast:   make(chan SSEMessage),
-		connections: make(map[*connection]bool),
-		register:    make(chan *connection),
-		unregister:  make(chan *connection),
-		shutdown:    make(chan bool),
-		startupTime: time.Now(),
+		broadcast:     make(chan SSEMessage),
+		publish:       make(chan publishRequest),
+		register:      make(chan *connection),
+		unregister:    make(chan *connection),
+		query:         make(chan *shardQuery),
+		shutdown:      make(chan bool),
+		done:          make(chan struct{}),
+		startupTime:   now,
+		opts:          &ServerOptions{},
+		retained:      newRetainedStore(),
+		conns:         make(map[uint64]*connection),
+		hooks:         &hookDispatcher{},
+		metrics:       newMetrics(),
+		presence:      newPresenceTracker(),
+		presenceFlush: make(chan struct{}),
+		// seed automatic IDs from the startup time, so that they continue to
+		// increase across restarts and are unlikely to collide with IDs a
+		// client may have seen from a previous process.
+		lastID: uint64(now.UnixNano()),
 	}
 }
 
+// publishRequest is a message to broadcast, along with a tally in which to
+// report its delivery.
+type publishRequest struct {
+	msg   SSEMessage
+	tally *deliveryTally
+}
+
 // Shutdown method for cancellation of hub run loop.
 //
-// right now we are only using this in tests, in the future we may want to be
-// able to more gracefully shut down a Server in production as well, but...
+// All connections are told to shutdown, after being sent the ShutdownMessage
+// if one is configured, and Shutdown returns once the run loop has exited.
+// Calling Shutdown on a hub which has already exited is a no-op.
 //
-// TODO: need to do some thinking before exposing this interface more broadly.
+// For gracefully shutting down a Server in production, see Server.Shutdown.
 func (h *hub) Shutdown() {
-	h.shutdown <- true
+	select {
+	case h.shutdown <- true:
+	case <-h.done:
+	}
+	<-h.done
+}
+
+// acquire records a new connection handler as active, unless the hub is
+// shutting down in which case it returns false. Handlers must call release
+// when done.
+func (h *hub) acquire() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closing {
+		return false
+	}
+	h.handlers.Add(1)
+	return true
+}
+
+func (h *hub) release() {
+	h.handlers.Done()
+}
+
+// stopAccepting causes all future calls to acquire to fail.
+func (h *hub) stopAccepting() {
+	h.mu.Lock()
+	h.closing = true
+	h.mu.Unlock()
+}
+
+// inspect runs fn in the run loop of each shard, once everything previously
+// sent to the hub has been processed, and waits for them all to complete.
+// Shards run concurrently, so fn must synchronize access to anything shared.
+//
+// Returns false without calling fn if the hub has exited.
+func (h *hub) inspect(fn func(sh *shard)) bool {
+	return h.runQuery(&shardQuery{fn: fn})
+}
+
+// runQuery sends q to the hub run loop and waits for all shards to complete it,
+// returning false if the hub has exited.
+func (h *hub) runQuery(q *shardQuery) bool {
+	q.done = make(chan struct{})
+	select {
+	case h.query <- q:
+	case <-h.done:
+		return false
+	}
+	<-q.done
+	return true
+}
+
+// slowConsumerStats sums the SlowConsumerStats of all shards.
+func (h *hub) slowConsumerStats() (stats SlowConsumerStats) {
+	var mu sync.Mutex
+	h.inspect(func(sh *shard) {
+		mu.Lock()
+		defer mu.Unlock()
+		stats.add(sh.slowStats)
+	})
+	return stats
+}
+
+// hubStatus is a point in time snapshot of the state of the hub.
+type hubStatus struct {
+	sentMsgs      uint64
+	slowConsumers SlowConsumerStats
+	connections   []connectionStatus
+}
+
+// snapshot collects a hubStatus via the hub and shard run loops, rather than
+// reading their state out from under them, so it is consistent with every
+// message sent to the hub prior to the call.
+func (h *hub) snapshot() hubStatus {
+	var (
+		st hubStatus
+		mu sync.Mutex
+	)
+	q := &shardQuery{
+		hubFn: func(h *hub) { st.sentMsgs = h.sentMsgs },
+		fn: func(sh *shard) {
+			mu.Lock()
+			defer mu.Unlock()
+			st.slowConsumers.add(sh.slowStats)
+			for c := range sh.connections {
+				st.connections = append(st.connections, c.Status())
+			}
+		},
+	}
+	if !h.runQuery(q) {
+		// the run loop has exited so nothing is registered, and it is now safe
+		// to read what it left behind.
+		st.sentMsgs = h.sentMsgs
+	}
+	return st
+}
+
+// connectionStatus returns the status of the registered connection with the
+// given ID, if there is one.
+func (h *hub) connectionStatus(id uint64) (st connectionStatus, ok bool) {
+	h.runQuery(&shardQuery{
+		hubFn: func(h *hub) {
+			if c := h.conns[id]; c != nil {
+				st, ok = c.Status(), true
+			}
+		},
+	})
+	return st, ok
+}
+
+// kick disconnects the registered connection with the given ID, first queueing
+// farewell for it if set. It goes via the shard which owns the connection, so
+// cannot race with the shard disconnecting it for some other reason. Returns
+// false if there was no such connection.
+func (h *hub) kick(id uint64, farewell []byte) bool {
+	var (
+		target *connection
+		kicked bool
+	)
+	h.runQuery(&shardQuery{
+		hubFn: func(h *hub) { target = h.conns[id] },
+		fn: func(sh *shard) {
+			if target != nil && sh.connections[target] {
+				sh._sendFarewell(target, farewell)
+				sh._shutdownConn(target, DisconnectKicked)
+				kicked = true
+			}
+		},
+	})
+	return kicked
 }
 
 // Start begins the main run loop for a hub in a background go func.
@@ -54,68 +233,236 @@ func (h *hub) run() {
 	for {
 		select {
 		case <-h.shutdown:
-			debug.Debug(fmt.Sprintf("hub shutdown requested, cancelling %d connections...", len(h.connections)))
-			for c := range h.connections {
-				h._shutdownConn(c)
+			h._start()
+			debug.Debug(fmt.Sprintf("hub shutdown requested, cancelling connections in %d shards...", len(h.shards)))
+			var farewell []byte
+			if msg := h.opts.ShutdownMessage; msg != nil {
+				farewell = msg.sseFormat()
+			}
+			for _, sh := range h.shards {
+				sh.ops <- shardOp{kind: opShutdown, frame: farewell}
+			}
+			for _, sh := range h.shards {
+				<-sh.done
 			}
 			debug.Debug("...All connections cancelled, shutting down now.")
+			close(h.done)
 			return
 		case c := <-h.register:
-			debug.Debug("new connection being registered for " + c.namespace)
-			h.connections[c] = true
+			debug.Debug("new connection being registered for " + c.String())
+			h._registerConn(c)
 		case c := <-h.unregister:
-			debug.Debug("connection told us to unregister for " + c.namespace)
+			debug.Debug("connection told us to unregister for " + c.String())
 			h._unregisterConn(c)
 		case msg := <-h.broadcast:
 			h.sentMsgs++
-			h._broadcastMessage(msg)
+			h._broadcastMessage(msg, nil)
+		case req := <-h.publish:
+			h.sentMsgs++
+			h._broadcastMessage(req.msg, req.tally)
+		case bm, ok := <-h.incoming:
+			if !ok { // backplane was closed
+				h.incoming = nil
+				continue
+			}
+			h._receiveMessage(bm)
+		case <-h.presenceFlush:
+			h._flushPresence()
+		case q := <-h.query:
+			h._start()
+			if q.hubFn != nil {
+				q.hubFn(h)
+			}
+			q.pending = int32(len(h.shards))
+			for _, sh := range h.shards {
+				sh.ops <- shardOp{kind: opQuery, query: q}
+			}
 		}
 	}
 }
 
-// internal method, removes that client from the hub and tells it to shutdown
+// internal method, starts the shards, sets up replay, and connects to the
+// backplane if they have not been already.
+//
+// This is deferred until first needed, rather than done when the hub is
+// created, so that the corresponding ServerOptions can be set after the Server
+// has been created.
+func (h *hub) _start() {
+	if h.shards != nil {
+		return
+	}
+	n := h.opts.Shards
+	if n < 1 {
+		n = 1
+	}
+	h.shards = make([]*shard, n)
+	for i := range h.shards {
+		h.shards[i] = newShard(h.opts, h.hooks)
+		go h.shards[i].run()
+	}
+
+	if h.opts.Journal != nil {
+		h.replay = h.opts.Journal
+	} else if h.opts.ReplayBufferSize > 0 {
+		h.replay = newReplayBuffer(h.opts.ReplayBufferSize)
+	}
+
+	if h.backplane = h.opts.Backplane; h.backplane != nil {
+		h.nodeID = h.opts.NodeID
+		if h.nodeID == "" {
+			h.nodeID = randomNodeID()
+		}
+		h.incoming = h.backplane.Messages()
+	}
+}
+
+// internal method, assigns a client to a shard, replaying any messages it
+// missed before it begins receiving new ones.
+// _register is safe to call multiple times with the same connection
+func (h *hub) _registerConn(c *connection) {
+	first := c.shard == nil
+	if first {
+		h._start()
+		h.lastConnID++
+		c.id = h.lastConnID
+		// a resuming client will have already seen the retained messages, or
+		// be sent their replacements in the replay.
+		if !h._replayMessages(c) {
+			h._sendRetained(c)
+		}
+		c.shard = h.shards[h.nextShard]
+		h.nextShard = (h.nextShard + 1) % len(h.shards)
+	}
+	if !c.present {
+		c.present = true
+		h.conns[c.id] = c
+		h._updatePresence(c, 1)
+	}
+	c.shard.ops <- shardOp{kind: opRegister, conn: c}
+	if first {
+		h.onConnect(c)
+	}
+}
+
+// internal method, removes that client from its shard
 // _unregister is safe to call multiple times with the same connection
 func (h *hub) _unregisterConn(c *connection) {
-	delete(h.connections, c)
+	if c.present {
+		c.present = false
+		delete(h.conns, c.id)
+		h._updatePresence(c, -1)
+	}
+	if c.shard != nil {
+		c.shard.ops <- shardOp{kind: opUnregister, conn: c}
+	}
 }
 
-// internal method, removes that client from the hub and tells it to shutdown
-// must only be called once for a given connection to avoid panic!
-func (h *hub) _shutdownConn(c *connection) {
-	// for maximum safety, ALWAYS unregister a connection from the hub prior to
-	// shutting it down, as we want no possibility of a send on closed channel
-	// panic.
-	h._unregisterConn(c)
-	// close the connection's send channel, which will cause it to exit its
-	// event loop and return to the HTTP handler.
-	close(c.send)
+// internal method, queues any messages a resuming connection missed since its
+// Last-Event-ID onto its send channel, prior to it receiving live messages.
+// Returns whether the connection was able to resume.
+//
+// Replay is limited by backlogLimit, should more messages have been missed only
+// the most recent are sent.
+func (h *hub) _replayMessages(c *connection) bool {
+	if c.lastEventID == "" || h.replay == nil {
+		return false
+	}
+	frames, ok := h.replay.since(c.lastEventID, c.wants, backlogLimit(c))
+	debug.Debug(fmt.Sprintf("replaying %d missed messages for %s", len(frames), c))
+	now := time.Now()
+	for _, f := range frames {
+		c.send <- queuedMsg{frame: f, at: now}
+	}
+	return ok
 }
 
-// internal method, broadcast a message to all matching clients if this fails
-// due to any client having a full send buffer,
-func (h *hub) _broadcastMessage(msg SSEMessage) {
-	formattedMsg := msg.sseFormat()
-	for c := range h.connections {
-		if strings.HasPrefix(msg.Namespace, c.namespace) {
-			select {
-			case c.send <- formattedMsg:
-			default:
-				debug.Debug("cant pass to a connection send chan, buffer is full -- kill it with fire")
-				h._shutdownConn(c)
-				/*
-					we are already closing the send channel, in *theory* shouldn't the
-					connection clean up? I guess possible it doesnt if its deadlocked or
-					something... is it?
-
-					closing the send channel will result in our handleFunc exiting, which Go
-					treats as meaning we are done with the connection... but what if it's wedged?
-
-					TODO: investigate using panic in a http.Handler, to absolutely force
-
-					we want to make sure to always close the HTTP connection though,
-					so server can never fill up max num of open sockets.
-				*/
-			}
+// backlogLimit is how many more messages may be queued for a new connection
+// before it receives live messages, up to half its send buffer. Filling it
+// would leave no room for live messages, and get the connection disconnected
+// as a slow consumer before it has had a chance to catch up.
+func backlogLimit(c *connection) int {
+	if limit := cap(c.send)/2 - len(c.send); limit > 0 {
+		return limit
+	}
+	return 0
+}
+
+// internal method, queues the retained messages for all namespaces a new
+// connection is subscribed to onto its send channel, prior to it receiving live
+// messages.
+//
+// Like replay, this is limited by backlogLimit.
+func (h *hub) _sendRetained(c *connection) {
+	now := time.Now()
+	frames := h.retained.matching(c.wants, backlogLimit(c), now)
+	for _, f := range frames {
+		c.send <- queuedMsg{frame: f, at: now}
+	}
+}
+
+// internal method, broadcasts a message sent to this node, both to our own
+// clients and to other nodes via the backplane if there is one. If tally is
+// non-nil, it will be sent the DeliveryReport for our own clients.
+func (h *hub) _broadcastMessage(msg SSEMessage, tally *deliveryTally) {
+	h._start()
+	// line breaks are removed from the ID when it is sent, which is what the
+	// client will resume from, so it must be recorded and shared the same way
+	msg.ID = stripLineBreaks(msg.ID)
+	// IDs are assigned only by the node a message originated on, so that they
+	// are the same everywhere and clients can resume on any node.
+	if h.replay != nil && msg.ID == "" && !msg.retryOnly() && !msg.clearsRetained() {
+		h.lastID++
+		msg.ID = strconv.FormatUint(h.lastID, 10)
+	}
+	h._deliverMessage(msg, tally)
+	if h.backplane != nil {
+		bm := BackplaneMessage{Origin: h.nodeID, Message: msg}
+		if err := h.backplane.Publish(bm); err != nil {
+			debug.Debug("error publishing to backplane: " + err.Error())
 		}
 	}
 }
+
+// internal method, broadcasts a message received via the backplane to our own
+// clients, unless it is one of ours coming back around.
+func (h *hub) _receiveMessage(bm BackplaneMessage) {
+	if bm.Origin == h.nodeID {
+		return
+	}
+	h.sentMsgs++
+	h._deliverMessage(bm.Message, nil)
+}
+
+// internal method, records a message for replay and retention as required, and
+// then delivers it to our own clients. If tally is non-nil, it will be sent the
+// DeliveryReport.
+func (h *hub) _deliverMessage(msg SSEMessage, tally *deliveryTally) {
+	if msg.clearsRetained() {
+		h.retained.set(msg, nil, time.Now())
+		if tally != nil {
+			tally.done <- DeliveryReport{}
+		}
+		return
+	}
+	formattedMsg := msg.sseFormat()
+	if msg.Retain {
+		h.retained.set(msg, formattedMsg, time.Now())
+	}
+	if h.replay != nil {
+		h.replay.add(msg, formattedMsg)
+	}
+	h._fanoutMessage(msg, formattedMsg, tally)
+}
+
+// internal method, hands off an already formatted message to all shards for
+// delivery to their matching clients. If tally is non-nil, each shard will
+// report its deliveries to it.
+func (h *hub) _fanoutMessage(msg SSEMessage, formattedMsg []byte, tally *deliveryTally) {
+	if tally != nil {
+		tally.pending = len(h.shards)
+	}
+	op := shardOp{kind: opBroadcast, msg: msg, frame: formattedMsg, at: time.Now(), tally: tally}
+	for _, sh := range h.shards {
+		sh.ops <- op
+	}
+}
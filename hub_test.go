@@ -1,7 +1,12 @@
 package sseserver
 
 import (
+	"net/http/httptest"
+	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,9 +22,10 @@ func mockHub(numConnections int) (h *hub) {
 
 func mockConn(namespace string) *connection {
 	return &connection{
-		send:      make(chan []byte, connBufSize),
-		created:   time.Now(),
-		namespace: namespace,
+		r:          httptest.NewRequest("GET", "/subscribe"+namespace, nil),
+		send:       make(chan queuedMsg, connBufSize),
+		created:    time.Now(),
+		namespaces: []string{namespace},
 	}
 }
 
@@ -37,9 +43,9 @@ func mockSinkedHub(initialConnections map[string]int) (h *hub) {
 // mock a connection that sinks data sent to it
 func mockSinkedConn(namespace string, h *hub) *connection {
 	c := &connection{
-		send:      make(chan []byte, connBufSize),
-		created:   time.Now(),
-		namespace: namespace,
+		send:       make(chan queuedMsg, connBufSize),
+		created:    time.Now(),
+		namespaces: []string{namespace},
 	}
 	go func() {
 		for range c.send {
@@ -47,11 +53,29 @@ func mockSinkedConn(namespace string, h *hub) *connection {
 			// (versus using <-c.send in infinite loop)
 		}
 		// in practice, a connection tries to unregister itself here
-		h.unregister <- c
+		select {
+		case h.unregister <- c:
+		case <-h.done:
+		}
 	}()
 	return c
 }
 
+// registered returns the set of connections currently registered with the
+// shards of a hub, after everything previously sent to the hub is processed.
+func registered(h *hub) map[*connection]bool {
+	var mu sync.Mutex
+	conns := make(map[*connection]bool)
+	h.inspect(func(sh *shard) {
+		mu.Lock()
+		defer mu.Unlock()
+		for c := range sh.connections {
+			conns[c] = true
+		}
+	})
+	return conns
+}
+
 type deliveryCase struct {
 	conn     *connection
 	expected int
@@ -65,7 +89,7 @@ func TestBroadcastSingleplex(t *testing.T) {
 	h.register <- c2
 
 	//broadcast to foo channel
-	h.broadcast <- SSEMessage{"", []byte("yo"), "/foo"}
+	h.broadcast <- SSEMessage{Data: []byte("yo"), Namespace: "/foo"}
 	h.Shutdown() // ensures delivery is finished
 
 	//check for proper delivery
@@ -92,9 +116,9 @@ func TestBroadcastMultiplex(t *testing.T) {
 	h.register <- c3
 
 	//broadcast to channels
-	h.broadcast <- SSEMessage{"", []byte("yo"), "/foo"}
-	h.broadcast <- SSEMessage{"", []byte("yo"), "/foo"}
-	h.broadcast <- SSEMessage{"", []byte("yo"), "/bar"}
+	h.broadcast <- SSEMessage{Data: []byte("yo"), Namespace: "/foo"}
+	h.broadcast <- SSEMessage{Data: []byte("yo"), Namespace: "/foo"}
+	h.broadcast <- SSEMessage{Data: []byte("yo"), Namespace: "/bar"}
 	h.Shutdown() // ensures delivery is finished
 
 	//check for proper delivery
@@ -124,9 +148,9 @@ func TestBroadcastWildcards(t *testing.T) {
 	h.register <- cOther
 
 	//broadcast to channels
-	h.broadcast <- SSEMessage{"", []byte("woof"), "/pets/dogs"}
-	h.broadcast <- SSEMessage{"", []byte("meow"), "/pets/cats"}
-	h.broadcast <- SSEMessage{"", []byte("wahh"), "/kids"}
+	h.broadcast <- SSEMessage{Data: []byte("woof"), Namespace: "/pets/dogs"}
+	h.broadcast <- SSEMessage{Data: []byte("meow"), Namespace: "/pets/cats"}
+	h.broadcast <- SSEMessage{Data: []byte("wahh"), Namespace: "/kids"}
 	h.Shutdown() // ensures delivery is finished
 
 	//check for proper delivery
@@ -139,7 +163,134 @@ func TestBroadcastWildcards(t *testing.T) {
 	for _, c := range d {
 		if actual := len(c.conn.send); actual != c.expected {
 			t.Errorf("Expected conn %v to have %d message in queue, actual: %d",
-				c.conn.namespace, c.expected, actual)
+				c.conn, c.expected, actual)
+		}
+	}
+}
+
+// namespaces match on whole segments, and subscriptions can opt in to wildcards
+func TestBroadcastSegments(t *testing.T) {
+	h := mockHub(0)
+	cPet := mockConn("/pet")
+	cPets := mockConn("/pets")
+	cAdopted := mockConn("/pets/*/adopted")
+	cDeep := mockConn("/pets/**/adopted")
+
+	h.register <- cPet
+	h.register <- cPets
+	h.register <- cAdopted
+	h.register <- cDeep
+
+	//broadcast to channels
+	h.broadcast <- SSEMessage{Data: []byte("hi"), Namespace: "/pets/dogs/adopted"}
+	h.broadcast <- SSEMessage{Data: []byte("hi"), Namespace: "/pets/dogs/wild/adopted"}
+	h.broadcast <- SSEMessage{Data: []byte("hi"), Namespace: "/petstore"}
+	h.Shutdown() // ensures delivery is finished
+
+	//check for proper delivery
+	d := []deliveryCase{
+		{cPet, 0},
+		{cPets, 2},
+		{cAdopted, 1},
+		{cDeep, 2},
+	}
+	for _, c := range d {
+		if actual := len(c.conn.send); actual != c.expected {
+			t.Errorf("Expected conn %v to have %d message in queue, actual: %d",
+				c.conn, c.expected, actual)
+		}
+	}
+}
+
+// a connection with multiple subscriptions gets messages matching any of them,
+// but only once even if more than one matches
+func TestBroadcastMultipleNamespaces(t *testing.T) {
+	h := mockHub(0)
+	c := mockConn("/pets")
+	c.namespaces = append(c.namespaces, "/pets/cats", "/time")
+	h.register <- c
+
+	h.broadcast <- SSEMessage{Data: []byte("meow"), Namespace: "/pets/cats"}
+	h.broadcast <- SSEMessage{Data: []byte("tick"), Namespace: "/time"}
+	h.broadcast <- SSEMessage{Data: []byte("wahh"), Namespace: "/kids"}
+	h.Shutdown() // ensures delivery is finished
+
+	if actual, expected := len(c.send), 2; actual != expected {
+		t.Errorf("Expected conn to have %d messages in queue, actual: %d",
+			expected, actual)
+	}
+}
+
+// connections filtering on event type should only receive those events, both
+// live and when being replayed
+func TestBroadcastEventFilter(t *testing.T) {
+	h := mockHub(0)
+	h.opts.ReplayBufferSize = 10
+	h.broadcast <- SSEMessage{Event: "new-dog", Data: []byte("a"), Namespace: "/pets", ID: "1"}
+	h.broadcast <- SSEMessage{Event: "new-cat", Data: []byte("b"), Namespace: "/pets", ID: "2"}
+	h.broadcast <- SSEMessage{Event: "new-dog", Data: []byte("c"), Namespace: "/pets", ID: "3"}
+
+	c := mockConn("/pets")
+	c.events = eventFilter{include: []string{"new-dog"}}
+	c.lastEventID = "1"
+	h.register <- c
+	h.broadcast <- SSEMessage{Event: "new-cat", Data: []byte("d"), Namespace: "/pets"}
+	h.broadcast <- SSEMessage{Event: "new-dog", Data: []byte("e"), Namespace: "/pets"}
+	h.Shutdown() // ensures delivery is finished
+
+	var actual []string
+	for f := range c.send {
+		actual = append(actual, string(f.frame))
+	}
+	if len(actual) != 2 ||
+		!strings.HasSuffix(actual[0], "data:c\n\n") ||
+		!strings.HasSuffix(actual[1], "data:e\n\n") {
+		t.Errorf("unexpected msgs delivered: %q", actual)
+	}
+}
+
+// with multiple shards, every connection should still get every message, in
+// the order they were broadcast
+func TestBroadcastSharded(t *testing.T) {
+	h := mockHub(0)
+	h.opts.Shards = 4
+	var conns []*connection
+	for i := 0; i < 10; i++ {
+		c := mockConn("/pets")
+		conns = append(conns, c)
+		h.register <- c
+	}
+
+	const numMsgs = 100
+	for i := 0; i < numMsgs; i++ {
+		h.broadcast <- SSEMessage{Data: []byte(strconv.Itoa(i)), Namespace: "/pets"}
+	}
+	if actual := len(h.shards); actual != 4 {
+		t.Errorf("unexpected num of shards: got %d want %d", actual, 4)
+	}
+	for _, sh := range h.shards {
+		sh := sh
+		var n int
+		h.inspect(func(s *shard) {
+			if s == sh {
+				n = len(s.connections)
+			}
+		})
+		if n < 2 || n > 3 {
+			t.Errorf("connections not spread evenly across shards, shard had %d", n)
+		}
+	}
+	h.Shutdown() // ensures delivery is finished
+
+	for _, c := range conns {
+		msgs := drain(c)
+		if len(msgs) != numMsgs {
+			t.Fatalf("unexpected num of msgs: got %d want %d", len(msgs), numMsgs)
+		}
+		for i, m := range msgs {
+			if m != strconv.Itoa(i) {
+				t.Fatalf("msgs out of order: got %q at position %d", m, i)
+			}
 		}
 	}
 }
@@ -161,7 +312,7 @@ func TestDoubleUnregister(t *testing.T) {
 	h.broadcast <- SSEMessage{Data: []byte("no-op to ensure finished")}
 	// ^^ the above broadcast forces the hub run loop to be past the initial
 	// registrations, preventing a possible race condition.
-	actual, expected := len(h.connections), 1
+	actual, expected := len(registered(h)), 1
 	if actual != expected {
 		t.Errorf("unexpected num of conns: got %v want %v", actual, expected)
 	}
@@ -178,7 +329,7 @@ func TestDoubleRegister(t *testing.T) {
 	h.broadcast <- SSEMessage{Data: []byte("no-op to ensure finished")}
 	// ^^ the above broadcast forces the hub run loop to be past the initial
 	// registrations, preventing a possible race condition.
-	actual, expected := len(h.connections), 1
+	actual, expected := len(registered(h)), 1
 	if actual != expected {
 		t.Errorf("unexpected num of conns: got %v want %v", actual, expected)
 	}
@@ -197,7 +348,7 @@ func TestKillsStalledConnection(t *testing.T) {
 	h.broadcast <- SSEMessage{Data: []byte("no-op to ensure finished")}
 	// ^^ the above broadcast forces the hub run loop to be past the initial
 	// registrations, preventing a possible race condition.
-	numSetupConns := len(h.connections)
+	numSetupConns := len(registered(h))
 	if numSetupConns != 2 {
 		t.Fatal("unexpected num of conns after test setup!:", numSetupConns)
 	}
@@ -206,22 +357,153 @@ func TestKillsStalledConnection(t *testing.T) {
 	msg := SSEMessage{Data: []byte("hi"), Namespace: namespace}
 	for i := 0; i <= connBufSize+(connBufSize*0.5); i++ {
 		h.broadcast <- msg
-		// need to pause execution the tiniest bit to allow
-		// other goroutines to execute if running on GOMAXPROCS=1
-		time.Sleep(time.Microsecond)
+		// need to let the sinked connection catch up, otherwise on GOMAXPROCS=1
+		// the scheduler may keep ping-ponging between us and the hub and never
+		// get around to running it, in which case it would be stalled too.
+		for len(sinked.send) > 0 {
+			runtime.Gosched()
+		}
 	}
 
 	// one of the connections should have been shutdown now...
 	expected := 1
-	if actual := len(h.connections); actual != expected {
+	if actual := len(registered(h)); actual != expected {
 		t.Errorf("unexpected num of conns: got %v want %v", actual, expected)
 	}
 	// ...and it better not be our taco loving friend
-	if _, ok := h.connections[sinked]; !ok {
+	if _, ok := registered(h)[sinked]; !ok {
 		t.Error("wrong connection appears to have been shutdown!")
 	}
 }
 
+// mock a connection with a tiny send buffer that nobody reads from, and fill it
+func mockFullConn(namespace string, h *hub) *connection {
+	c := &connection{
+		r:          httptest.NewRequest("GET", "/subscribe"+namespace, nil),
+		send:       make(chan queuedMsg, 2),
+		created:    time.Now(),
+		namespaces: []string{namespace},
+	}
+	h.register <- c
+	for i := 0; i < cap(c.send); i++ {
+		h.broadcast <- SSEMessage{Data: []byte("filler"), Namespace: namespace}
+	}
+	return c
+}
+
+// drain returns the Data of all messages remaining in a closed send chan
+func drain(c *connection) (msgs []string) {
+	for f := range c.send {
+		msgs = append(msgs, strings.TrimSuffix(strings.TrimPrefix(string(f.frame), "data:"), "\n\n"))
+	}
+	return msgs
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	var policyTests = []struct {
+		policy   SlowConsumerPolicy
+		expected []string
+		stats    SlowConsumerStats
+	}{
+		{SlowConsumerDropOldest, []string{"2", "3"}, SlowConsumerStats{DroppedOldest: 3}},
+		{SlowConsumerDropNewest, []string{"filler", "filler"}, SlowConsumerStats{DroppedNewest: 3}},
+		{SlowConsumerConflate, []string{"3"}, SlowConsumerStats{Conflated: 4}},
+	}
+	for _, pt := range policyTests {
+		t.Run(pt.policy.String(), func(t *testing.T) {
+			h := mockHub(0)
+			h.opts.SlowConsumerPolicy = pt.policy
+			c := mockFullConn("/dash", h)
+			for _, data := range []string{"1", "2", "3"} {
+				h.broadcast <- SSEMessage{Data: []byte(data), Namespace: "/dash"}
+			}
+			h.broadcast <- SSEMessage{Data: []byte("no-op to ensure finished")}
+			if _, ok := registered(h)[c]; !ok {
+				t.Error("connection should not have been disconnected")
+			}
+			if stats := h.slowConsumerStats(); stats != pt.stats {
+				t.Errorf("unexpected stats: got %+v want %+v", stats, pt.stats)
+			}
+			h.Shutdown()
+
+			actual := drain(c)
+			if strings.Join(actual, ",") != strings.Join(pt.expected, ",") {
+				t.Errorf("unexpected queued msgs: got %v want %v", actual, pt.expected)
+			}
+		})
+	}
+}
+
+// a connection which stays full for longer than the timeout should eventually
+// be disconnected, even with a policy which otherwise would not.
+func TestSlowConsumerTimeout(t *testing.T) {
+	h := mockHub(0)
+	defer h.Shutdown()
+	h.opts.SlowConsumerPolicy = SlowConsumerDropNewest
+	h.opts.SlowConsumerTimeout = time.Millisecond
+
+	c := mockFullConn("/dash", h)
+	msg := SSEMessage{Data: []byte("hi"), Namespace: "/dash"}
+	h.broadcast <- msg // starts the stall clock
+	time.Sleep(5 * time.Millisecond)
+	h.broadcast <- msg // ...which has now expired
+	h.broadcast <- SSEMessage{Data: []byte("no-op to ensure finished")}
+
+	if _, ok := registered(h)[c]; ok {
+		t.Error("stalled connection should have been disconnected")
+	}
+	expected := SlowConsumerStats{DroppedNewest: 1, Disconnected: 1}
+	if stats := h.slowConsumerStats(); stats != expected {
+		t.Errorf("unexpected stats: got %+v want %+v", stats, expected)
+	}
+}
+
+// the slow consumer policy can be overridden for a namespace, based on where
+// the message that overflowed the buffer was broadcast.
+func TestSlowConsumerNamespacePolicy(t *testing.T) {
+	h := mockHub(0)
+	defer h.Shutdown()
+	h.opts.Namespaces = map[string]NamespaceOptions{
+		"/dash":      {SlowConsumerPolicy: SlowConsumerDropNewest},
+		"/dash/live": {SlowConsumerPolicy: SlowConsumerDisconnect},
+	}
+
+	c := mockFullConn("/dash", h)
+	h.broadcast <- SSEMessage{Data: []byte("hi"), Namespace: "/dash/cpu"}
+	h.broadcast <- SSEMessage{Data: []byte("no-op to ensure finished")}
+	if _, ok := registered(h)[c]; !ok {
+		t.Fatal("connection should not have been disconnected by /dash policy")
+	}
+	h.broadcast <- SSEMessage{Data: []byte("hi"), Namespace: "/dash/live"}
+	h.broadcast <- SSEMessage{Data: []byte("no-op to ensure finished")}
+	if _, ok := registered(h)[c]; ok {
+		t.Error("connection should have been disconnected by /dash/live policy")
+	}
+}
+
+// benchmark fan-out across increasing numbers of shards, run with -cpu to see
+// how this scales with the available cores, e.g. -cpu 1,2,4,8
+func BenchmarkBroadcastShards(b *testing.B) {
+	var msgBytes = []byte("foo bar woo")
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(shards), func(b *testing.B) {
+			h := newHub()
+			h.opts.Shards = shards
+			h.Start()
+			for i := 0; i < 10000; i++ {
+				h.register <- mockSinkedConn("/test", h)
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				h.broadcast <- SSEMessage{Data: msgBytes, Namespace: "/test"}
+			}
+			h.inspect(func(*shard) {}) // wait for delivery to finish
+			b.StopTimer()
+			h.Shutdown()
+		})
+	}
+}
+
 func BenchmarkRegister(b *testing.B) {
 	h := mockHub(0)
 	defer h.Shutdown()
@@ -257,7 +539,7 @@ func BenchmarkBroadcast(b *testing.B) {
 			h := mockSinkedHub(map[string]int{"/test": s})
 			b.ResetTimer()
 			for n := 0; n < b.N; n++ {
-				h.broadcast <- SSEMessage{"", msgBytes, "/test"}
+				h.broadcast <- SSEMessage{Data: msgBytes, Namespace: "/test"}
 			}
 			b.StopTimer()
 			h.Shutdown()
@@ -285,7 +567,7 @@ func BenchmarkBroadcastNS(b *testing.B) {
 					hub := mockDensityHub(s)
 					b.ResetTimer()
 					for n := 0; n < b.N; n++ {
-						hub.broadcast <- SSEMessage{"", msgBytes, slashName}
+						hub.broadcast <- SSEMessage{Data: msgBytes, Namespace: slashName}
 					}
 					b.StopTimer()
 					hub.Shutdown()
@@ -295,4 +577,214 @@ func BenchmarkBroadcastNS(b *testing.B) {
 	}
 	benchAllSizes("dense")
 	benchAllSizes("sparse")
+
+	// many fine-grained namespaces with few subscribers each, where a message
+	// only targets one of them. cost should be proportional to the matching
+	// subscribers, not the total number of connections.
+	b.Run("finegrained", func(b *testing.B) {
+		for _, s := range []int{1000, 10000, 100000} {
+			b.Run(strconv.Itoa(s), func(b *testing.B) {
+				const numNamespaces = 1000
+				conns := make(map[string]int, numNamespaces)
+				for i := 0; i < numNamespaces; i++ {
+					conns["/emoji/"+strconv.Itoa(i)] = s / numNamespaces
+				}
+				hub := mockSinkedHub(conns)
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					hub.broadcast <- SSEMessage{Data: msgBytes, Namespace: "/emoji/42"}
+				}
+				b.StopTimer()
+				hub.Shutdown()
+			})
+		}
+	})
+}
+
+// with replay enabled, a connection resuming from a Last-Event-ID should be
+// sent everything it missed in matching namespaces, in order, before anything
+// broadcast after it reconnected.
+func TestReplayLastEventID(t *testing.T) {
+	h := mockHub(0)
+	h.opts.ReplayBufferSize = 10
+
+	msgs := []SSEMessage{
+		{Data: []byte("woof"), Namespace: "/pets/dogs", ID: "1"},
+		{Data: []byte("meow"), Namespace: "/pets/cats", ID: "2"},
+		{Data: []byte("wahh"), Namespace: "/kids", ID: "3"},
+		{Data: []byte("bark"), Namespace: "/pets/dogs", ID: "4"},
+	}
+	for _, msg := range msgs {
+		h.broadcast <- msg
+	}
+
+	resumed := mockConn("/pets")
+	resumed.lastEventID = "1"
+	unknown := mockConn("/pets")
+	unknown.lastEventID = "nope"
+	h.register <- resumed
+	h.register <- unknown
+	live := SSEMessage{Data: []byte("hiss"), Namespace: "/pets/cats", ID: "5"}
+	h.broadcast <- live
+	h.Shutdown() // ensures delivery is finished
+
+	expected := [][]byte{msgs[1].sseFormat(), msgs[3].sseFormat(), live.sseFormat()}
+	var actual [][]byte
+	for f := range resumed.send {
+		actual = append(actual, f.frame)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("unexpected num of msgs: got %d want %d", len(actual), len(expected))
+	}
+	for i := range expected {
+		if string(actual[i]) != string(expected[i]) {
+			t.Errorf("msg %d: got %q want %q", i, actual[i], expected[i])
+		}
+	}
+
+	// an ID we know nothing about cant be resumed from, so just get live msgs
+	if actual := len(unknown.send); actual != 1 {
+		t.Errorf("unexpected num of msgs for unknown ID: got %d want %d", actual, 1)
+	}
+}
+
+// an ID containing line breaks is sent without them, which is what a client
+// will then resume from
+func TestReplayIDWithLineBreaks(t *testing.T) {
+	h := mockHub(0)
+	h.opts.ReplayBufferSize = 10
+	h.broadcast <- SSEMessage{Data: []byte("woof"), Namespace: "/pets", ID: "4\r\n2"}
+	h.broadcast <- SSEMessage{Data: []byte("bark"), Namespace: "/pets", ID: "43"}
+
+	c := mockConn("/pets")
+	c.lastEventID = "42"
+	h.register <- c
+	h.Shutdown() // ensures delivery is finished
+	var frames []string
+	for f := range c.send {
+		frames = append(frames, string(f.frame))
+	}
+	if expected := []string{"id:43\ndata:bark\n\n"}; !reflect.DeepEqual(frames, expected) {
+		t.Errorf("unexpected msgs replayed: got %q want %q", frames, expected)
+	}
+}
+
+// replay should leave room in the send buffer for live messages, sending only
+// the most recent of those missed
+func TestReplayLimit(t *testing.T) {
+	h := mockHub(0)
+	h.opts.ReplayBufferSize = 20
+	for i := 0; i <= 10; i++ {
+		h.broadcast <- SSEMessage{Data: []byte("woof"), Namespace: "/pets", ID: strconv.Itoa(i)}
+	}
+
+	c := mockConn("/pets")
+	c.send = make(chan queuedMsg, 4)
+	c.lastEventID = "0"
+	h.register <- c
+	h.Shutdown() // ensures delivery is finished
+
+	var ids []string
+	for f := range c.send {
+		ids = append(ids, strings.TrimPrefix(strings.SplitN(string(f.frame), "\n", 2)[0], "id:"))
+	}
+	if expected := []string{"9", "10"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("unexpected msgs replayed: got %v want %v", ids, expected)
+	}
+}
+
+// with replay enabled, messages without an ID should be assigned one
+func TestReplayAssignsIDs(t *testing.T) {
+	h := mockHub(0)
+	h.opts.ReplayBufferSize = 10
+	c := mockConn("/")
+	h.register <- c
+	h.broadcast <- SSEMessage{Data: []byte("a"), Namespace: "/foo"}
+	h.broadcast <- SSEMessage{Data: []byte("b"), Namespace: "/foo"}
+	h.broadcast <- SSEMessage{Data: []byte("c"), Namespace: "/foo", ID: "mine"}
+	h.Shutdown() // ensures delivery is finished
+
+	first, second, third := string((<-c.send).frame), string((<-c.send).frame), string((<-c.send).frame)
+	if !strings.HasPrefix(first, "id:") || !strings.HasPrefix(second, "id:") {
+		t.Fatalf("expected assigned IDs, got %q and %q", first, second)
+	}
+	if first >= second {
+		t.Errorf("expected increasing IDs, got %q then %q", first, second)
+	}
+	if expected := "id:mine\ndata:c\n\n"; third != expected {
+		t.Errorf("publisher ID was not kept: got %q want %q", third, expected)
+	}
+}
+
+// new subscribers should be sent the latest retained message for each matching
+// namespace, in the order they were retained.
+func TestRetainedMessages(t *testing.T) {
+	h := mockHub(0)
+	defer h.Shutdown()
+	retain := func(ns, data string) {
+		h.broadcast <- SSEMessage{Data: []byte(data), Namespace: ns, Retain: true}
+	}
+	subscribe := func(ns string) []string {
+		c := mockConn(ns)
+		h.register <- c
+		h.unregister <- c
+		h.inspect(func(*shard) {}) // wait for registration to finish
+		close(c.send)
+		return drain(c)
+	}
+
+	retain("/scores/a", "1")
+	retain("/scores/b", "2")
+	h.broadcast <- SSEMessage{Data: []byte("not retained"), Namespace: "/scores/c"}
+	retain("/other", "3")
+	retain("/scores/a", "4")
+	if actual, expected := subscribe("/scores"), []string{"2", "4"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected retained msgs: got %q want %q", actual, expected)
+	}
+
+	// clearing
+	h.broadcast <- SSEMessage{Namespace: "/scores/b", Retain: true}
+	if actual, expected := subscribe("/scores"), []string{"4"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected retained msgs after clearing: got %q want %q", actual, expected)
+	}
+
+	// expiry
+	h.broadcast <- SSEMessage{Data: []byte("5"), Namespace: "/scores/a", Retain: true, RetainFor: time.Millisecond}
+	time.Sleep(5 * time.Millisecond)
+	if actual := subscribe("/scores"); len(actual) != 0 {
+		t.Errorf("unexpected retained msgs after expiry: got %q", actual)
+	}
+}
+
+// retained messages should leave room in the send buffer for live messages,
+// sending only the most recently retained
+func TestRetainedLimit(t *testing.T) {
+	h := mockHub(0)
+	for i := 0; i < 10; i++ {
+		h.broadcast <- SSEMessage{Data: []byte(strconv.Itoa(i)), Namespace: "/scores/" + strconv.Itoa(i), Retain: true}
+	}
+
+	c := mockConn("/scores")
+	c.send = make(chan queuedMsg, 4)
+	h.register <- c
+	h.Shutdown() // ensures delivery is finished
+	if actual, expected := drain(c), []string{"8", "9"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected retained msgs: got %q want %q", actual, expected)
+	}
+}
+
+// a message clearing a retained value is not itself delivered to anyone
+func TestRetainedClearNotDelivered(t *testing.T) {
+	h := mockHub(0)
+	c := mockConn("/scores")
+	h.register <- c
+	tally := newDeliveryTally()
+	h.publish <- publishRequest{msg: SSEMessage{Namespace: "/scores", Retain: true}, tally: tally}
+	if report := <-tally.done; report != (DeliveryReport{}) {
+		t.Errorf("unexpected report: got %+v", report)
+	}
+	h.Shutdown()
+	if msgs := drain(c); len(msgs) != 0 {
+		t.Errorf("unexpected msgs: got %q", msgs)
+	}
 }
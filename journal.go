@@ -0,0 +1,511 @@
+package sseserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azer/debug"
+)
+
+const (
+	journalExt             = ".journal"
+	journalHeaderSize      = 8 // payload length and checksum, both uint32
+	defaultJournalSegment  = 16 << 20
+	maxJournalRecordLength = 1 << 30
+)
+
+var errJournalCorrupt = errors.New("sseserver: corrupt journal record")
+
+// JournalOptions configures a Journal.
+type JournalOptions struct {
+	// SegmentSize is the size in bytes at which the journal starts writing to
+	// a new segment file. Retention is applied a segment at a time. Defaults
+	// to 16MiB.
+	SegmentSize int64
+	// MaxAge is how long messages are retained for. Zero means forever.
+	MaxAge time.Duration
+	// MaxBytes is the total size of all segments the journal will retain
+	// before removing the oldest. Zero means no limit.
+	MaxBytes int64
+	// Sync causes every message to be flushed to stable storage as it is
+	// written, surviving power loss rather than just the process crashing,
+	// at a significant cost to throughput.
+	//
+	// Messages are written to the journal synchronously from the hub run loop
+	// as they are broadcast, so while a write, and with Sync the fsync which
+	// follows it, is in progress no shard can be sent any message.
+	Sync bool
+}
+
+// A Journal is an append-only log of broadcast messages kept on disk, which
+// can be used in place of the in-memory replay buffer (see
+// ServerOptions.Journal), so that clients can resume with a Last-Event-ID
+// after the Server restarts, and which can also be queried for history.
+//
+// The journal is stored in a directory as a series of segment files, the
+// oldest of which are removed according to the retention set in the
+// JournalOptions. An index of each message's namespace and ID is kept in
+// memory, while their contents are read from disk when needed, so that History
+// need only examine the namespaces asked for, and replay only what each
+// namespace has had since the client's Last-Event-ID.
+//
+// Should the process crash in the middle of writing a message, the partially
+// written message is discarded the next time the Journal is opened.
+//
+// A Journal is safe for concurrent use, however it must only be used by one
+// Server at a time.
+type Journal struct {
+	dir  string
+	opts JournalOptions
+	now  func() time.Time // for testing
+
+	mu       sync.Mutex
+	segments []*journalSegment         // oldest first, the last is written to
+	entries  map[string][]journalEntry // index of messages by namespace, ordered by seq
+	ids      map[string]uint64         // most recent seq for each ID
+	nextSeq  uint64
+	closed   bool
+}
+
+// journalSegment is a single file of a Journal.
+type journalSegment struct {
+	f        *os.File
+	firstSeq uint64 // the segment is named for this
+	size     int64
+	lastTime time.Time // time the most recent message was written
+}
+
+// journalEntry is the in-memory index entry for a message in a Journal.
+type journalEntry struct {
+	seq       uint64
+	namespace string
+	id        string
+	event     string
+	seg       *journalSegment
+	offset    int64
+	length    int64 // including header
+}
+
+// OpenJournal opens the journal stored in dir, creating it if necessary.
+func OpenJournal(dir string, opts JournalOptions) (*Journal, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultJournalSegment
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		dir:     dir,
+		opts:    opts,
+		now:     time.Now,
+		entries: make(map[string][]journalEntry),
+		ids:     make(map[string]uint64),
+		nextSeq: 1,
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		if _, ok := parseSegmentName(fi.Name()); ok {
+			names = append(names, fi.Name())
+		} else if strings.HasSuffix(fi.Name(), journalExt) {
+			debug.Debug("ignoring unrecognized journal file " + fi.Name())
+		}
+	}
+	sort.Strings(names) // zero padded, so oldest first
+	for i, name := range names {
+		if err := j.load(name, i == len(names)-1); err != nil {
+			j.closeSegments()
+			return nil, err
+		}
+	}
+	if len(j.segments) == 0 {
+		if err := j.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	j.applyRetention()
+	return j, nil
+}
+
+// load reads the index entries from a segment file. The last segment is opened
+// for writing, and any incomplete or corrupt message at its end is truncated.
+func (j *Journal) load(name string, last bool) error {
+	firstSeq, _ := parseSegmentName(name)
+	flag := os.O_RDONLY
+	if last {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(filepath.Join(j.dir, name), flag, 0644)
+	if err != nil {
+		return err
+	}
+	seg := &journalSegment{f: f, firstSeq: firstSeq}
+
+	r := bufio.NewReader(f)
+	for {
+		msg, seq, written, n, err := readJournalRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			debug.Debug(fmt.Sprintf("journal %s damaged at offset %d: %v", name, seg.size, err))
+			if last {
+				// most likely torn by a crash mid-write, drop what's left
+				if err := f.Truncate(seg.size); err != nil {
+					f.Close()
+					return err
+				}
+			}
+			break
+		}
+		j.index(msg, seq, seg, seg.size, n)
+		seg.size += n
+		seg.lastTime = written
+	}
+
+	j.segments = append(j.segments, seg)
+	return nil
+}
+
+// parseSegmentName returns the first seq of the segment file with the given
+// name, or false if it is not the name of a segment.
+func parseSegmentName(name string) (uint64, bool) {
+	digits := strings.TrimSuffix(name, journalExt)
+	if len(digits) != 20 || len(name) == len(digits) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(digits, 10, 64)
+	return seq, err == nil
+}
+
+// index adds an entry for a message to the in-memory index.
+func (j *Journal) index(msg SSEMessage, seq uint64, seg *journalSegment, offset, length int64) {
+	j.entries[msg.Namespace] = append(j.entries[msg.Namespace], journalEntry{
+		seq:       seq,
+		namespace: msg.Namespace,
+		id:        msg.ID,
+		event:     msg.Event,
+		seg:       seg,
+		offset:    offset,
+		length:    length,
+	})
+	if msg.ID != "" {
+		j.ids[msg.ID] = seq
+	}
+	if seq >= j.nextSeq {
+		j.nextSeq = seq + 1
+	}
+}
+
+// rotate starts a new segment for writing.
+func (j *Journal) rotate() error {
+	name := fmt.Sprintf("%020d"+journalExt, j.nextSeq)
+	f, err := os.OpenFile(filepath.Join(j.dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	j.segments = append(j.segments, &journalSegment{f: f, firstSeq: j.nextSeq, lastTime: j.now()})
+	return nil
+}
+
+// applyRetention removes the oldest segments while they exceed the MaxAge or
+// MaxBytes, never removing the segment currently being written.
+func (j *Journal) applyRetention() {
+	for len(j.segments) > 1 {
+		oldest := j.segments[0]
+		expired := j.opts.MaxAge > 0 && j.now().Sub(oldest.lastTime) > j.opts.MaxAge
+		if !expired && !(j.opts.MaxBytes > 0 && j.totalSize() > j.opts.MaxBytes) {
+			return
+		}
+
+		for ns, entries := range j.entries {
+			n := 0
+			for n < len(entries) && entries[n].seg == oldest {
+				if e := entries[n]; j.ids[e.id] == e.seq {
+					delete(j.ids, e.id)
+				}
+				n++
+			}
+			if n == len(entries) {
+				delete(j.entries, ns)
+			} else {
+				j.entries[ns] = entries[n:]
+			}
+		}
+		j.segments = j.segments[1:]
+		oldest.f.Close()
+		if err := os.Remove(oldest.f.Name()); err != nil {
+			debug.Debug("error removing journal segment: " + err.Error())
+		}
+	}
+}
+
+func (j *Journal) totalSize() (n int64) {
+	for _, seg := range j.segments {
+		n += seg.size
+	}
+	return n
+}
+
+// add appends a message to the journal, implementing replayStore.
+func (j *Journal) add(msg SSEMessage, _ []byte) {
+	if err := j.append(msg); err != nil {
+		debug.Debug("error writing to journal: " + err.Error())
+	}
+}
+
+func (j *Journal) append(msg SSEMessage) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return os.ErrClosed
+	}
+
+	seg := j.segments[len(j.segments)-1]
+	if seg.size >= j.opts.SegmentSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+		seg = j.segments[len(j.segments)-1]
+	}
+
+	now := j.now()
+	rec := encodeJournalRecord(msg, j.nextSeq, now)
+	if _, err := seg.f.WriteAt(rec, seg.size); err != nil {
+		// don't leave a partial record behind for the next one to follow
+		seg.f.Truncate(seg.size)
+		return err
+	}
+	if j.opts.Sync {
+		if err := seg.f.Sync(); err != nil {
+			return err
+		}
+	}
+	j.index(msg, j.nextSeq, seg, seg.size, int64(len(rec)))
+	seg.size += int64(len(rec))
+	seg.lastTime = now
+	j.applyRetention()
+	return nil
+}
+
+// since implements replayStore.
+func (j *Journal) since(lastID string, wants func(namespace, event string) bool, limit int) ([][]byte, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	lastSeq, ok := j.ids[lastID]
+	if !ok {
+		return nil, false
+	}
+	msgs, err := j.collect(lastSeq, limit, nil, func(e journalEntry) bool {
+		return wants(e.namespace, e.event)
+	})
+	if err != nil {
+		debug.Debug("error reading from journal: " + err.Error())
+		return nil, false
+	}
+	frames := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		frames[i] = msg.sseFormat()
+	}
+	return frames, true
+}
+
+// History returns up to limit of the most recent messages in the journal whose
+// namespace matches the given subscription, oldest first. A subscription may
+// use wildcards, in the same way as when subscribing via HTTP.
+func (j *Journal) History(namespace string, limit int) ([]SSEMessage, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil, os.ErrClosed
+	}
+	return j.collect(0, limit, func(ns string) bool {
+		return matchNamespace(namespace, ns)
+	}, nil)
+}
+
+// collect reads up to limit of the most recent messages after seq, oldest
+// first, from the namespaces for which matchNS returns true, and of those, the
+// entries for which match returns true. Either may be nil to match everything.
+func (j *Journal) collect(after uint64, limit int, matchNS func(ns string) bool, match func(e journalEntry) bool) ([]SSEMessage, error) {
+	var matched []journalEntry
+	for ns, entries := range j.entries {
+		if matchNS != nil && !matchNS(ns) {
+			continue
+		}
+		first := sort.Search(len(entries), func(i int) bool { return entries[i].seq > after })
+		n := 0
+		for i := len(entries) - 1; i >= first && n < limit; i-- {
+			if match == nil || match(entries[i]) {
+				matched = append(matched, entries[i])
+				n++
+			}
+		}
+	}
+	sort.Slice(matched, func(i, k int) bool { return matched[i].seq < matched[k].seq })
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+
+	msgs := make([]SSEMessage, len(matched))
+	for i, e := range matched {
+		buf := make([]byte, e.length)
+		if _, err := e.seg.f.ReadAt(buf, e.offset); err != nil {
+			return nil, err
+		}
+		msg, _, _, _, err := readJournalRecord(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+// Close closes the journal files. It should not be called until the Server
+// using the Journal has been Shutdown.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	return j.closeSegments()
+}
+
+func (j *Journal) closeSegments() (err error) {
+	for _, seg := range j.segments {
+		if cerr := seg.f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// A journal record is a header of the payload length and its CRC-32, followed
+// by the payload: the seq, time written, and retry as varints, then the
+// namespace, ID, event, and data each prefixed by their length.
+func encodeJournalRecord(msg SSEMessage, seq uint64, written time.Time) []byte {
+	payload := make([]byte, 0, 3*binary.MaxVarintLen64+
+		4*binary.MaxVarintLen32+len(msg.Namespace)+len(msg.ID)+len(msg.Event)+len(msg.Data))
+	payload = appendUvarint(payload, seq)
+	payload = appendVarint(payload, written.UnixNano())
+	payload = appendVarint(payload, int64(msg.Retry))
+	for _, field := range [][]byte{[]byte(msg.Namespace), []byte(msg.ID), []byte(msg.Event), msg.Data} {
+		payload = appendUvarint(payload, uint64(len(field)))
+		payload = append(payload, field...)
+	}
+
+	rec := make([]byte, journalHeaderSize, journalHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(payload))
+	return append(rec, payload...)
+}
+
+// readJournalRecord reads the next record, returning io.EOF if there are none,
+// and io.ErrUnexpectedEOF or errJournalCorrupt if it is incomplete or damaged.
+func readJournalRecord(r io.Reader) (msg SSEMessage, seq uint64, written time.Time, length int64, err error) {
+	var header [journalHeaderSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(header[0:4])
+	if n > maxJournalRecordLength {
+		err = errJournalCorrupt
+		return
+	}
+	payload := make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		err = errJournalCorrupt
+		return
+	}
+	length = int64(journalHeaderSize + n)
+
+	d := journalDecoder{buf: payload}
+	seq = d.uvarint()
+	written = time.Unix(0, d.varint())
+	msg.Retry = time.Duration(d.varint())
+	msg.Namespace = string(d.bytes())
+	msg.ID = string(d.bytes())
+	msg.Event = string(d.bytes())
+	msg.Data = d.bytes()
+	if d.err {
+		err = errJournalCorrupt
+	}
+	return
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+// journalDecoder reads the fields of a journal record payload, setting err
+// rather than panicking should it be malformed.
+type journalDecoder struct {
+	buf []byte
+	err bool
+}
+
+func (d *journalDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err, d.buf = true, nil
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *journalDecoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err, d.buf = true, nil
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *journalDecoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.err, d.buf = true, nil
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
@@ -0,0 +1,264 @@
+package sseserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempJournal(t *testing.T, opts JournalOptions) (*Journal, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sseserver-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, dir
+}
+
+func reopen(t *testing.T, j *Journal, opts JournalOptions) *Journal {
+	t.Helper()
+	if err := j.Close(); err != nil {
+		t.Fatal("error closing journal:", err)
+	}
+	j, err := OpenJournal(j.dir, opts)
+	if err != nil {
+		t.Fatal("error reopening journal:", err)
+	}
+	return j
+}
+
+func historyData(t *testing.T, j *Journal, namespace string) (data []string) {
+	t.Helper()
+	msgs, err := j.History(namespace, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		data = append(data, string(m.Data))
+	}
+	return data
+}
+
+// messages should survive reopening the journal, and resuming should pick up
+// where it left off.
+func TestJournalReopen(t *testing.T) {
+	j, dir := tempJournal(t, JournalOptions{})
+	defer os.RemoveAll(dir)
+
+	j.add(SSEMessage{Event: "new-dog", Data: []byte("Corgi"), Namespace: "/pets/dogs", ID: "1"}, nil)
+	j.add(SSEMessage{Event: "new-cat", Data: []byte("Persian"), Namespace: "/pets/cats", ID: "2", Retry: time.Second}, nil)
+	j = reopen(t, j, JournalOptions{})
+	defer j.Close()
+	j.add(SSEMessage{Data: []byte("Terrier"), Namespace: "/pets/dogs", ID: "3"}, nil)
+
+	msgs, err := j.History("/pets", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SSEMessage{
+		{Event: "new-dog", Data: []byte("Corgi"), Namespace: "/pets/dogs", ID: "1"},
+		{Event: "new-cat", Data: []byte("Persian"), Namespace: "/pets/cats", ID: "2", Retry: time.Second},
+		{Data: []byte("Terrier"), Namespace: "/pets/dogs", ID: "3"},
+	}
+	if !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("unexpected history:\ngot  %+v\nwant %+v", msgs, expected)
+	}
+	if actual := historyData(t, j, "/pets/dogs"); !reflect.DeepEqual(actual, []string{"Corgi", "Terrier"}) {
+		t.Errorf("unexpected history for namespace: got %q", actual)
+	}
+	if msgs, _ := j.History("/pets", 1); len(msgs) != 1 || msgs[0].ID != "3" {
+		t.Errorf("history should be limited to the most recent: got %+v", msgs)
+	}
+
+	dogs := func(ns, event string) bool { return ns == "/pets/dogs" }
+	frames, _ := j.since("1", dogs, 10)
+	if len(frames) != 1 || string(frames[0]) != "id:3\ndata:Terrier\n\n" {
+		t.Errorf("unexpected frames since ID: got %q", frames)
+	}
+	if _, ok := j.since("unknown", dogs, 10); ok {
+		t.Errorf("expected no frames for unknown ID, got %q", frames)
+	}
+}
+
+// a message only partially written when the process died should be discarded,
+// without affecting those before it or written after.
+func TestJournalTornTail(t *testing.T) {
+	j, dir := tempJournal(t, JournalOptions{})
+	defer os.RemoveAll(dir)
+	for i := 1; i <= 3; i++ {
+		j.add(SSEMessage{Data: []byte(strconv.Itoa(i)), ID: strconv.Itoa(i)}, nil)
+	}
+	seg := j.segments[0].f.Name()
+	j.Close()
+
+	// lose the last few bytes of the final message
+	fi, err := os.Stat(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(seg, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = OpenJournal(dir, JournalOptions{})
+	if err != nil {
+		t.Fatal("error opening torn journal:", err)
+	}
+	if actual := historyData(t, j, "/"); !reflect.DeepEqual(actual, []string{"1", "2"}) {
+		t.Errorf("unexpected history after recovery: got %q", actual)
+	}
+	j.add(SSEMessage{Data: []byte("4"), ID: "4"}, nil)
+	j = reopen(t, j, JournalOptions{})
+	defer j.Close()
+	if actual := historyData(t, j, "/"); !reflect.DeepEqual(actual, []string{"1", "2", "4"}) {
+		t.Errorf("unexpected history after writing to recovered journal: got %q", actual)
+	}
+}
+
+// other files in the directory should not be mistaken for the segment to
+// write to
+func TestJournalStrayFiles(t *testing.T) {
+	j, dir := tempJournal(t, JournalOptions{})
+	defer os.RemoveAll(dir)
+	j.add(SSEMessage{Data: []byte("1"), ID: "1"}, nil)
+	j.Close()
+	for _, name := range []string{"notes" + journalExt, "1" + journalExt, "zzz"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j, err := OpenJournal(dir, JournalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.append(SSEMessage{Data: []byte("2"), ID: "2"}); err != nil {
+		t.Fatal("error appending:", err)
+	}
+	j = reopen(t, j, JournalOptions{})
+	defer j.Close()
+	if actual := historyData(t, j, "/"); !reflect.DeepEqual(actual, []string{"1", "2"}) {
+		t.Errorf("unexpected history: got %q", actual)
+	}
+}
+
+// history and replay should be drawn from the namespaces asked for, however
+// much has since been written to others
+func TestJournalNamespaceIndex(t *testing.T) {
+	j, dir := tempJournal(t, JournalOptions{SegmentSize: 200, MaxBytes: 1000})
+	defer os.RemoveAll(dir)
+	defer j.Close()
+	j.add(SSEMessage{Data: []byte("woof"), Namespace: "/pets/dogs", ID: "dog"}, nil)
+	j.add(SSEMessage{Data: []byte("meow"), Namespace: "/pets/cats", ID: "cat"}, nil)
+	for i := 0; i < 10; i++ {
+		j.add(SSEMessage{Data: []byte("tick"), Namespace: "/time", ID: strconv.Itoa(i)}, nil)
+	}
+	j.add(SSEMessage{Data: []byte("bark"), Namespace: "/pets/dogs"}, nil)
+
+	if actual := historyData(t, j, "/pets"); !reflect.DeepEqual(actual, []string{"woof", "meow", "bark"}) {
+		t.Errorf("unexpected history: got %q", actual)
+	}
+	if msgs, _ := j.History("/pets", 2); len(msgs) != 2 || string(msgs[0].Data) != "meow" {
+		t.Errorf("history should be limited to the most recent: got %+v", msgs)
+	}
+	pets := func(ns, event string) bool { return matchNamespace("/pets", ns) }
+	frames, _ := j.since("dog", pets, 10)
+	if len(frames) != 2 || string(frames[1]) != "data:bark\n\n" {
+		t.Errorf("unexpected frames since ID: got %q", frames)
+	}
+
+	// namespaces with nothing left are dropped from the index
+	for i := 0; i < 100; i++ {
+		j.add(SSEMessage{Data: []byte("tock"), Namespace: "/time"}, nil)
+	}
+	if len(j.entries) != 1 {
+		t.Errorf("unexpected namespaces indexed after retention: got %d want 1", len(j.entries))
+	}
+	if actual := historyData(t, j, "/pets"); len(actual) != 0 {
+		t.Errorf("unexpected history after retention: got %q", actual)
+	}
+}
+
+func TestJournalRetention(t *testing.T) {
+	segments := func(dir string) int {
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+journalExt))
+		return len(files)
+	}
+
+	t.Run("size", func(t *testing.T) {
+		opts := JournalOptions{SegmentSize: 100, MaxBytes: 250}
+		j, dir := tempJournal(t, opts)
+		defer os.RemoveAll(dir)
+		defer j.Close()
+		for i := 1; i <= 20; i++ {
+			j.add(SSEMessage{Data: []byte("0123456789012345678901234567890123456789"), ID: strconv.Itoa(i)}, nil)
+		}
+		if n := segments(dir); n > 3 {
+			t.Errorf("too many segments retained: %d", n)
+		}
+		if _, ok := j.since("1", func(string, string) bool { return true }, 100); ok {
+			t.Error("expected removed ID to not be found")
+		}
+		if frames, _ := j.since("19", func(string, string) bool { return true }, 100); len(frames) != 1 {
+			t.Errorf("unexpected frames for retained ID: got %d want 1", len(frames))
+		}
+	})
+
+	t.Run("age", func(t *testing.T) {
+		opts := JournalOptions{SegmentSize: 1, MaxAge: time.Hour}
+		j, dir := tempJournal(t, opts)
+		defer os.RemoveAll(dir)
+		defer j.Close()
+		now := time.Now()
+		j.now = func() time.Time { return now }
+		j.add(SSEMessage{Data: []byte("old"), ID: "1"}, nil)
+		now = now.Add(2 * time.Hour)
+		j.add(SSEMessage{Data: []byte("new"), ID: "2"}, nil)
+		j.add(SSEMessage{Data: []byte("newer"), ID: "3"}, nil)
+		if actual := historyData(t, j, "/"); !reflect.DeepEqual(actual, []string{"new", "newer"}) {
+			t.Errorf("unexpected history after expiry: got %q", actual)
+		}
+		if n := segments(dir); n != 2 {
+			t.Errorf("unexpected num of segments: got %d want %d", n, 2)
+		}
+	})
+}
+
+// clients should be able to resume from before a restart when using a Journal.
+func TestReplayJournalAcrossRestart(t *testing.T) {
+	j, dir := tempJournal(t, JournalOptions{})
+	defer os.RemoveAll(dir)
+
+	h := mockHub(0)
+	h.opts.Journal = j
+	c := mockConn("/pets")
+	h.register <- c
+	for _, d := range []string{"1", "2", "3"} {
+		h.broadcast <- SSEMessage{Data: []byte(d), Namespace: "/pets"}
+	}
+	h.Shutdown()
+	frames := drain(c)
+	j = reopen(t, j, JournalOptions{})
+	defer j.Close()
+
+	h = mockHub(0)
+	defer h.Shutdown()
+	h.opts.Journal = j
+	c = mockConn("/pets")
+	c.lastEventID = strings.TrimPrefix(strings.SplitN(frames[0], "\n", 2)[0], "id:")
+	h.register <- c
+	for _, d := range []string{"2", "3"} {
+		if f := receive(t, c); !strings.HasSuffix(f, "\ndata:"+d+"\n\n") {
+			t.Errorf("unexpected replayed msg: got %q want data %q", f, d)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package sseserver
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/azer/debug"
+)
+
+const (
+	meshQueueSize        = 1024             // msgs queued per peer while it is slow or unreachable
+	meshMaxMessageSize   = 16 << 20         // largest encoded msg a node will accept
+	meshDialTimeout      = 5 * time.Second  // how long to wait connecting to a peer
+	meshWriteTimeout     = 10 * time.Second // how long to wait writing to a peer
+	meshHandshakeTimeout = 5 * time.Second  // how long a peer has to prove it knows the key
+	meshMinBackoff       = 100 * time.Millisecond
+	meshMaxBackoff       = 5 * time.Second
+)
+
+// Mesh is a Backplane which connects sseserver nodes directly to one another
+// over TCP, without any external dependencies.
+//
+// Each node listens for connections from the others, and dials every one of
+// its peers, over which it sends the messages broadcast on it. Messages are
+// never forwarded on by the nodes receiving them, so every node must be given
+// the address of every other.
+//
+// Nodes share a secret key, and each connection begins with a handshake in
+// which the dialling node proves it knows it, by signing a random challenge
+// from the listening node, so that nobody else able to reach the port can
+// broadcast. Messages are not encrypted however, so a Mesh should only listen
+// on a private network, or be tunnelled over one.
+//
+// Should a peer be unreachable its connection is retried indefinitely, with
+// messages for it queued in the meantime. If the queue fills up, messages for
+// that peer are dropped until it catches up.
+type Mesh struct {
+	ln       net.Listener
+	key      []byte
+	incoming chan BackplaneMessage
+	quit     chan struct{}
+	wg       sync.WaitGroup // accept loop, readers, and peers
+
+	mu      sync.Mutex // Guards everything below
+	peers   map[string]*meshPeer
+	inbound map[net.Conn]bool
+	closed  bool
+}
+
+// ErrMeshKeyRequired is returned by NewMesh when not given a key.
+var ErrMeshKeyRequired = errors.New("sseserver: mesh key required")
+
+// errMeshHandshake is the error when a peer fails the handshake.
+var errMeshHandshake = errors.New("sseserver: mesh handshake failed")
+
+// NewMesh creates a Mesh listening for other nodes on addr, and connecting to
+// each of the peers. All nodes must be given the same key, see Mesh. More
+// peers can be added later with AddPeer.
+func NewMesh(addr string, key []byte, peers ...string) (*Mesh, error) {
+	if len(key) == 0 {
+		return nil, ErrMeshKeyRequired
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mesh{
+		ln:       ln,
+		key:      key,
+		incoming: make(chan BackplaneMessage, meshQueueSize),
+		quit:     make(chan struct{}),
+		peers:    make(map[string]*meshPeer),
+		inbound:  make(map[net.Conn]bool),
+	}
+	m.wg.Add(1)
+	go m.accept()
+	for _, p := range peers {
+		m.AddPeer(p)
+	}
+	return m, nil
+}
+
+// Addr returns the address the Mesh is listening on, which is useful when it
+// was created with an ephemeral port.
+func (m *Mesh) Addr() net.Addr {
+	return m.ln.Addr()
+}
+
+// AddPeer begins connecting to the node listening on addr, if not already.
+func (m *Mesh) AddPeer(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || m.peers[addr] != nil {
+		return
+	}
+	p := &meshPeer{addr: addr, key: m.key, queue: make(chan []byte, meshQueueSize)}
+	m.peers[addr] = p
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		p.run(m.quit)
+	}()
+}
+
+// Publish queues a message to be sent to every peer.
+func (m *Mesh) Publish(msg BackplaneMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrBackplaneClosed
+	}
+	for _, p := range m.peers {
+		select {
+		case p.queue <- line:
+		default:
+			debug.Debug("mesh queue for peer " + p.addr + " is full, dropping msg")
+		}
+	}
+	return nil
+}
+
+// Messages returns the channel on which messages from peers are received.
+func (m *Mesh) Messages() <-chan BackplaneMessage {
+	return m.incoming
+}
+
+// Close stops listening and disconnects from all peers, discarding any queued
+// messages.
+func (m *Mesh) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.quit)
+	err := m.ln.Close()
+	for c := range m.inbound {
+		c.Close()
+	}
+	m.mu.Unlock()
+
+	m.wg.Wait()
+	close(m.incoming)
+	return err
+}
+
+// accept handles inbound connections from peers, until the listener is closed.
+func (m *Mesh) accept() {
+	defer m.wg.Done()
+	for {
+		c, err := m.ln.Accept()
+		if err != nil {
+			select {
+			case <-m.quit:
+				return
+			default:
+			}
+			debug.Debug("mesh error accepting connection: " + err.Error())
+			time.Sleep(meshMinBackoff)
+			continue
+		}
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			c.Close()
+			return
+		}
+		m.inbound[c] = true
+		m.wg.Add(1)
+		m.mu.Unlock()
+		go m.read(c)
+	}
+}
+
+// read receives messages from an inbound connection until it is closed.
+func (m *Mesh) read(c net.Conn) {
+	defer m.wg.Done()
+	defer func() {
+		m.mu.Lock()
+		delete(m.inbound, c)
+		m.mu.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	if err := m.challenge(c, r); err != nil {
+		debug.Debug("mesh rejected connection from " + c.RemoteAddr().String() + ": " + err.Error())
+		return
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), meshMaxMessageSize)
+	for scanner.Scan() {
+		var msg BackplaneMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			debug.Debug("mesh received malformed msg, disconnecting: " + err.Error())
+			return
+		}
+		select {
+		case m.incoming <- msg:
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// challenge performs the handshake for an inbound connection, sending it a
+// random challenge and checking the reply is signed with our key, see
+// meshSignature. Once accepted the connection is told "ok".
+func (m *Mesh) challenge(c net.Conn, r *bufio.Reader) error {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	if _, err := fmt.Fprintf(c, "%x\n", challenge); err != nil {
+		return err
+	}
+	reply, err := readMeshLine(r)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(reply, meshSignature(m.key, challenge)) {
+		return errMeshHandshake
+	}
+	if _, err := fmt.Fprint(c, "ok\n"); err != nil {
+		return err
+	}
+	return c.SetDeadline(time.Time{})
+}
+
+// meshSignature signs a handshake challenge with key.
+func meshSignature(key, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// readMeshLine reads a hex encoded line of the handshake.
+func readMeshLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(string(line[:len(line)-1]))
+}
+
+// meshPeer is an outbound connection to another node.
+type meshPeer struct {
+	addr  string
+	key   []byte
+	queue chan []byte // encoded msgs waiting to be sent
+}
+
+// run maintains a connection to the peer, sending it queued messages, until
+// quit is closed.
+func (p *meshPeer) run(quit <-chan struct{}) {
+	var (
+		pending []byte // msg which failed to send, to retry after reconnecting
+		backoff = meshMinBackoff
+	)
+	for {
+		c, err := net.DialTimeout("tcp", p.addr, meshDialTimeout)
+		if err == nil {
+			if err = p.handshake(c); err != nil {
+				c.Close()
+			}
+		}
+		if err != nil {
+			debug.Debug("mesh error connecting to peer " + p.addr + ": " + err.Error())
+			select {
+			case <-time.After(backoff):
+			case <-quit:
+				return
+			}
+			if backoff *= 2; backoff > meshMaxBackoff {
+				backoff = meshMaxBackoff
+			}
+			continue
+		}
+		backoff = meshMinBackoff
+
+		pending = p.send(c, pending, quit)
+		c.Close()
+		select {
+		case <-quit:
+			return
+		default:
+		}
+	}
+}
+
+// handshake answers the challenge sent by the peer on a new connection, see
+// Mesh.challenge.
+func (p *meshPeer) handshake(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(meshHandshakeTimeout))
+	r := bufio.NewReader(c)
+	challenge, err := readMeshLine(r)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c, "%x\n", meshSignature(p.key, challenge)); err != nil {
+		return err
+	}
+	// the peer hangs up rather than saying ok on a bad signature
+	if ok, err := r.ReadString('\n'); err != nil || ok != "ok\n" {
+		return errMeshHandshake
+	}
+	return c.SetDeadline(time.Time{})
+}
+
+// send writes pending (if any) and then queued messages to c, until either
+// writing fails or quit is closed. Returns the message that failed to send.
+func (p *meshPeer) send(c net.Conn, pending []byte, quit <-chan struct{}) []byte {
+	w := bufio.NewWriter(c)
+	for {
+		if pending != nil {
+			c.SetWriteDeadline(time.Now().Add(meshWriteTimeout))
+			if _, err := w.Write(pending); err != nil {
+				debug.Debug("mesh error writing to peer " + p.addr + ": " + err.Error())
+				return pending
+			}
+			pending = nil
+		}
+		// batch up writes while there are more queued, flushing once idle
+		if len(p.queue) == 0 {
+			if err := w.Flush(); err != nil {
+				debug.Debug("mesh error writing to peer " + p.addr + ": " + err.Error())
+				return nil
+			}
+		}
+		select {
+		case pending = <-p.queue:
+		case <-quit:
+			return nil
+		}
+	}
+}
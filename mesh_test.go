@@ -0,0 +1,122 @@
+package sseserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMeshKey = []byte("hunter2")
+
+// every node in a mesh should receive every message broadcast on any of them
+// exactly once.
+func TestMesh(t *testing.T) {
+	var meshes []*Mesh
+	var backplanes []Backplane
+	for i := 0; i < 3; i++ {
+		m, err := NewMesh("127.0.0.1:0", testMeshKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		meshes = append(meshes, m)
+		backplanes = append(backplanes, m)
+	}
+	for _, m := range meshes {
+		for _, peer := range meshes {
+			if peer != m {
+				m.AddPeer(peer.Addr().String())
+			}
+		}
+	}
+
+	servers, conns := mockNodes("/pets", backplanes...)
+	for _, origin := range servers {
+		msg := SSEMessage{Event: "new-dog", Data: []byte("Corgi\nTerrier"), Namespace: "/pets/dogs"}
+		origin.Broadcast <- msg
+		for i, c := range conns {
+			f := receive(t, c)
+			if expected := "event:new-dog\ndata:Corgi\ndata:Terrier\n\n"; !strings.HasSuffix(f, expected) {
+				t.Errorf("node %d received unexpected msg: got %q want suffix %q", i, f, expected)
+			}
+		}
+	}
+
+	for i, s := range servers {
+		s.hub.Shutdown()
+		if extra := drain(conns[i]); len(extra) > 0 {
+			t.Errorf("node %d received unexpected msgs: %q", i, extra)
+		}
+	}
+}
+
+func TestMeshClose(t *testing.T) {
+	m, err := NewMesh("127.0.0.1:0", testMeshKey, "127.0.0.1:1") // peer which never answers
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Publish(BackplaneMessage{Origin: "test"})
+	if err := m.Close(); err != nil {
+		t.Error("unexpected error closing:", err)
+	}
+	if err := m.Publish(BackplaneMessage{}); err != ErrBackplaneClosed {
+		t.Errorf("unexpected error: got %v want %v", err, ErrBackplaneClosed)
+	}
+	if _, ok := <-m.Messages(); ok {
+		t.Error("expected Messages chan to be closed")
+	}
+}
+
+// only nodes with the key should be able to broadcast through a mesh
+func TestMeshHandshake(t *testing.T) {
+	if _, err := NewMesh("127.0.0.1:0", nil); err != ErrMeshKeyRequired {
+		t.Errorf("unexpected error without key: got %v want %v", err, ErrMeshKeyRequired)
+	}
+
+	m, err := NewMesh("127.0.0.1:0", testMeshKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	imposter, err := NewMesh("127.0.0.1:0", []byte("letmein"), m.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imposter.Close()
+	imposter.Publish(BackplaneMessage{Origin: "imposter"})
+
+	// nor anyone who ignores the handshake altogether
+	c, err := net.Dial("tcp", m.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprint(c, "{\"origin\":\"anyone\"}\n")
+	if _, err := bufio.NewReader(c).ReadString('\n'); err != nil {
+		t.Fatal("expected challenge:", err)
+	}
+
+	peer, err := NewMesh("127.0.0.1:0", testMeshKey, m.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.Publish(BackplaneMessage{Origin: "peer"})
+
+	select {
+	case msg := <-m.Messages():
+		if msg.Origin != "peer" {
+			t.Errorf("unexpected msg from %q", msg.Origin)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for msg from peer")
+	}
+	select {
+	case msg := <-m.Messages():
+		t.Errorf("unexpected msg from %q", msg.Origin)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,22 +1,75 @@
 package sseserver
 
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // SSEMessage is a message suitable for sending over a Server-Sent Event stream.
 //
 // Note: Namespace is not part of the SSE spec, it is merely used internally to
 // map a message to the appropriate HTTP virtual endpoint.
 //
+// If ID is left blank and the Server has a replay buffer enabled, the hub will
+// automatically assign a monotonically increasing ID to the message prior to
+// broadcasting it.
+//
+// Data may safely contain line breaks, it will be split across multiple data
+// fields as required by the spec and reassembled by the client. Line breaks are
+// not permitted in Event or ID, and will be stripped.
+//
+// Retry instructs the client how long to wait before reconnecting should the
+// connection be lost. A message with only a Retry (no Event, ID, or Data) is
+// sent as a bare retry instruction, and does not dispatch an event.
+//
+// If Retain is set, the message is also kept as the latest value for its
+// namespace, and sent to new subscribers as soon as they connect, until it is
+// replaced by another retained message, expires after RetainFor (if set), or is
+// cleared by broadcasting a retained message with no Data to the namespace.
 type SSEMessage struct {
-	Event     string // event scope for the message [optional]
-	Data      []byte // message payload
-	Namespace string // namespace for msg, matches to client subscriptions
+	Event     string        // event scope for the message [optional]
+	Data      []byte        // message payload
+	Namespace string        // namespace for msg, matches to client subscriptions
+	ID        string        // event id for the message, used for resuming [optional]
+	Retry     time.Duration // client reconnection delay, millisecond precision [optional]
+	Retain    bool          // keep as the latest value for the namespace [optional]
+	RetainFor time.Duration // how long to keep a retained msg, zero is forever [optional]
 }
 
 // sseFormat is the formatted bytestring for a SSE message, ready to be sent.
 func (msg SSEMessage) sseFormat() []byte {
 	// var b []byte but add initial capacity of length of keys, fields, and linebreaks.
-	// will be +1 byte wasted capacity if in nonevented case, does that really matter?
-	// cost of the comparison branch before allocation may outweight the 1 byte saving.
-	b := make([]byte, 0, 6+5+len(msg.Event)+len(msg.Data)+3)
+	// will be a few bytes wasted capacity in the nonevented/non-ID case, does that
+	// really matter? cost of the comparison branches before allocation may
+	// outweight the saving.
+	b := make([]byte, 0, 3+len(msg.ID)+6+5+len(msg.Event)+len(msg.Data)+4)
+	if msg.Retry > 0 {
+		b = appendRetry(b, msg.Retry)
+		if msg.retryOnly() {
+			return append(b, '\n')
+		}
+	}
+
+	// slow path: something needs to be split or sanitized. multi-line data is
+	// uncommon enough we dont bother estimating the extra capacity needed.
+	if hasLineBreak(msg.Data) || strHasLineBreak(msg.Event) || strHasLineBreak(msg.ID) {
+		if msg.ID != "" {
+			b = appendField(b, "id:", msg.ID)
+		}
+		if msg.Event != "" {
+			b = appendField(b, "event:", msg.Event)
+		}
+		b = appendData(b, msg.Data)
+		return append(b, '\n')
+	}
+
+	if msg.ID != "" {
+		b = append(b, "id:"...)
+		b = append(b, msg.ID...)
+		b = append(b, '\n')
+	}
 	if msg.Event != "" {
 		b = append(b, "event:"...)
 		b = append(b, msg.Event...)
@@ -27,3 +80,93 @@ func (msg SSEMessage) sseFormat() []byte {
 	b = append(b, '\n', '\n')
 	return b
 }
+
+// retryOnly reports whether the message is a bare retry instruction.
+func (msg SSEMessage) retryOnly() bool {
+	return msg.Retry > 0 && msg.Event == "" && msg.ID == "" && len(msg.Data) == 0
+}
+
+// clearsRetained reports whether the message clears the retained value for its
+// namespace, rather than being broadcast.
+func (msg SSEMessage) clearsRetained() bool {
+	return msg.Retain && len(msg.Data) == 0
+}
+
+// appendRetry appends a retry field to b, the spec defines this as an integer
+// number of milliseconds.
+func appendRetry(b []byte, d time.Duration) []byte {
+	b = append(b, "retry:"...)
+	b = strconv.AppendInt(b, int64(d/time.Millisecond), 10)
+	return append(b, '\n')
+}
+
+// hasLineBreak reports whether b contains any line breaks. The spec allows for
+// CRLF, LF, or a lone CR.
+//
+// This is on the hot path for every message, and the call overhead of the
+// vectorized IndexByte dominates for typical short payloads, so those are just
+// scanned directly.
+func hasLineBreak(b []byte) bool {
+	if len(b) > 64 {
+		return bytes.IndexByte(b, '\n') != -1 || bytes.IndexByte(b, '\r') != -1
+	}
+	for _, c := range b {
+		if c <= '\r' && (c == '\n' || c == '\r') {
+			return true
+		}
+	}
+	return false
+}
+
+// strHasLineBreak is hasLineBreak for (short) string fields.
+func strHasLineBreak(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= '\r' && (c == '\n' || c == '\r') {
+			return true
+		}
+	}
+	return false
+}
+
+// stripLineBreaks returns s without any line breaks, as it would be written by
+// appendField.
+func stripLineBreaks(s string) string {
+	if !strHasLineBreak(s) {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// appendField appends a single line field to b. Any line breaks in value would
+// allow it to spill into (and inject) additional fields, so they are removed.
+func appendField(b []byte, key, value string) []byte {
+	b = append(b, key...)
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\r' && value[i] != '\n' {
+			b = append(b, value[i])
+		}
+	}
+	return append(b, '\n')
+}
+
+// appendData appends data to b, splitting it into one data field per line.
+func appendData(b, data []byte) []byte {
+	for hasLineBreak(data) {
+		i := bytes.IndexAny(data, "\r\n")
+		b = append(b, "data:"...)
+		b = append(b, data[:i]...)
+		b = append(b, '\n')
+		if data[i] == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			i++ // CRLF counts as a single line break
+		}
+		data = data[i+1:]
+	}
+	b = append(b, "data:"...)
+	b = append(b, data...)
+	return append(b, '\n')
+}
@@ -1,6 +1,10 @@
 package sseserver
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+)
 
 var messageTests = []struct {
 	msg         SSEMessage
@@ -8,15 +12,55 @@ var messageTests = []struct {
 	description string
 }{
 	{
-		SSEMessage{"", []byte("foobar"), "abcd"},
+		SSEMessage{Data: []byte("foobar"), Namespace: "abcd"},
 		[]byte("data:foobar\n\n"),
 		"DataFieldOnly",
 	},
 	{
-		SSEMessage{"e12", []byte("foobar"), "abcd"},
+		SSEMessage{Event: "e12", Data: []byte("foobar"), Namespace: "abcd"},
 		[]byte("event:e12\ndata:foobar\n\n"),
 		"Event+DataField",
 	},
+	{
+		SSEMessage{Event: "e12", Data: []byte("foobar"), Namespace: "abcd", ID: "42"},
+		[]byte("id:42\nevent:e12\ndata:foobar\n\n"),
+		"ID+Event+DataField",
+	},
+	{
+		SSEMessage{Event: "e12", Data: []byte("foobar"), Namespace: "abcd", Retry: 2500 * time.Millisecond},
+		[]byte("retry:2500\nevent:e12\ndata:foobar\n\n"),
+		"Retry+Event+DataField",
+	},
+	{
+		SSEMessage{Retry: 10 * time.Second},
+		[]byte("retry:10000\n\n"),
+		"RetryOnly",
+	},
+	{
+		SSEMessage{Data: []byte(strings.Repeat("x", 1024)), Namespace: "abcd"},
+		[]byte("data:" + strings.Repeat("x", 1024) + "\n\n"),
+		"LargeDataField",
+	},
+	{
+		SSEMessage{Data: []byte("foo\nbar\r\nbaz\rqux"), Namespace: "abcd"},
+		[]byte("data:foo\ndata:bar\ndata:baz\ndata:qux\n\n"),
+		"MultiLineData",
+	},
+	{
+		SSEMessage{Data: []byte("{\n  \"a\": 1\n}\n"), Namespace: "abcd"},
+		[]byte("data:{\ndata:  \"a\": 1\ndata:}\ndata:\n\n"),
+		"MultiLineTrailingBreak",
+	},
+	{
+		SSEMessage{Data: []byte("a\n\nevent:evil"), Namespace: "abcd"},
+		[]byte("data:a\ndata:\ndata:event:evil\n\n"),
+		"DataInjection",
+	},
+	{
+		SSEMessage{Event: "e12\r\nevent:evil", Data: []byte("foobar"), Namespace: "abcd", ID: "4\n2"},
+		[]byte("id:42\nevent:e12event:evil\ndata:foobar\n\n"),
+		"FieldInjection",
+	},
 }
 
 func TestFormat(t *testing.T) {
@@ -0,0 +1,199 @@
+package sseserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are the counters updated by connection writers, outside of the hub
+// and shard run loops, so are accessed atomically.
+type metrics struct {
+	bytesWritten   uint64
+	keepalivesSent uint64
+	latency        *histogram // time from broadcast to flush, in ns
+}
+
+func newMetrics() *metrics {
+	return &metrics{latency: newLatencyHistogram()}
+}
+
+// wrote records a message being written and flushed to a connection.
+func (m *metrics) wrote(msg queuedMsg, n int) {
+	atomic.AddUint64(&m.bytesWritten, uint64(n))
+	m.latency.observe(uint64(time.Since(msg.at)))
+}
+
+// wroteKeepalive records a keepalive being written to a connection.
+func (m *metrics) wroteKeepalive(n int) {
+	atomic.AddUint64(&m.bytesWritten, uint64(n))
+	atomic.AddUint64(&m.keepalivesSent, 1)
+}
+
+func newLatencyHistogram() *histogram {
+	var bounds []uint64
+	for _, d := range []time.Duration{
+		100 * time.Microsecond, 500 * time.Microsecond,
+		time.Millisecond, 5 * time.Millisecond,
+		10 * time.Millisecond, 50 * time.Millisecond,
+		100 * time.Millisecond, 500 * time.Millisecond,
+		time.Second, 5 * time.Second,
+	} {
+		bounds = append(bounds, uint64(d))
+	}
+	return newHistogram(bounds...)
+}
+
+func newQueueDepthHistogram() *histogram {
+	return newHistogram(0, 1, 4, 16, 64, 256, 1024)
+}
+
+// histogram counts observations into buckets, safe for concurrent use.
+type histogram struct {
+	bounds []uint64 // inclusive upper bound of each bucket
+	counts []uint64 // for each bucket, plus a final one for everything else
+	sum    uint64
+}
+
+func newHistogram(bounds ...uint64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (hg *histogram) observe(v uint64) {
+	i := sort.Search(len(hg.bounds), func(i int) bool { return v <= hg.bounds[i] })
+	atomic.AddUint64(&hg.counts[i], 1)
+	atomic.AddUint64(&hg.sum, v)
+}
+
+// merge adds the observations of o, which must have the same bounds.
+func (hg *histogram) merge(o *histogram) {
+	for i := range o.counts {
+		atomic.AddUint64(&hg.counts[i], atomic.LoadUint64(&o.counts[i]))
+	}
+	atomic.AddUint64(&hg.sum, atomic.LoadUint64(&o.sum))
+}
+
+// write writes the histogram in the Prometheus text exposition format,
+// multiplying the bounds and sum by scale to convert them to the base unit.
+func (hg *histogram) write(w io.Writer, name, help string, scale float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, b := range hg.bounds {
+		cumulative += atomic.LoadUint64(&hg.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(float64(b)*scale), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&hg.counts[len(hg.bounds)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(float64(atomic.LoadUint64(&hg.sum))*scale))
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// namespaceRoot returns the first segment of a namespace, e.g. "/pets" for
+// "/pets/dogs", or "/" for the root itself.
+func namespaceRoot(namespace string) string {
+	root, _ := cutSegment(trimSub(namespace))
+	return "/" + root
+}
+
+// writeMetrics writes the metrics for a Server in the Prometheus text
+// exposition format.
+func writeMetrics(w io.Writer, s *Server) {
+	var (
+		mu         sync.Mutex
+		sentMsgs   uint64
+		open       int
+		roots      = make(map[string]int)
+		slow       SlowConsumerStats
+		queueDepth = newQueueDepthHistogram()
+	)
+	s.hub.runQuery(&shardQuery{
+		hubFn: func(h *hub) { sentMsgs = h.sentMsgs },
+		fn: func(sh *shard) {
+			mu.Lock()
+			defer mu.Unlock()
+			open += len(sh.connections)
+			for c := range sh.connections {
+				seen := make(map[string]bool, 1)
+				for _, ns := range c.namespaces {
+					if root := namespaceRoot(ns); !seen[root] {
+						seen[root] = true
+						roots[root]++
+					}
+				}
+			}
+			slow.add(sh.slowStats)
+			queueDepth.merge(sh.queueDepth)
+		},
+	})
+	m := s.hub.metrics
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	fmt.Fprint(bw, "# HELP sseserver_connections Open connections.\n# TYPE sseserver_connections gauge\n")
+	fmt.Fprintf(bw, "sseserver_connections %d\n", open)
+
+	fmt.Fprint(bw, "# HELP sseserver_namespace_connections Open connections, by the root of the namespaces subscribed to.\n# TYPE sseserver_namespace_connections gauge\n")
+	var names []string
+	for root := range roots {
+		names = append(names, root)
+	}
+	sort.Strings(names)
+	for _, root := range names {
+		fmt.Fprintf(bw, "sseserver_namespace_connections{namespace_root=\"%s\"} %d\n", escapeLabel(root), roots[root])
+	}
+
+	fmt.Fprint(bw, "# HELP sseserver_messages_broadcast_total Messages broadcast.\n# TYPE sseserver_messages_broadcast_total counter\n")
+	fmt.Fprintf(bw, "sseserver_messages_broadcast_total %d\n", sentMsgs)
+
+	fmt.Fprint(bw, "# HELP sseserver_bytes_written_total Bytes written to connections, including keepalives.\n# TYPE sseserver_bytes_written_total counter\n")
+	fmt.Fprintf(bw, "sseserver_bytes_written_total %d\n", atomic.LoadUint64(&m.bytesWritten))
+
+	fmt.Fprint(bw, "# HELP sseserver_keepalives_sent_total Keepalives written to connections.\n# TYPE sseserver_keepalives_sent_total counter\n")
+	fmt.Fprintf(bw, "sseserver_keepalives_sent_total %d\n", atomic.LoadUint64(&m.keepalivesSent))
+
+	fmt.Fprint(bw, "# HELP sseserver_slow_consumer_total Outcomes of the slow consumer policy.\n# TYPE sseserver_slow_consumer_total counter\n")
+	for _, o := range []struct {
+		outcome string
+		n       uint64
+	}{
+		{"disconnected", slow.Disconnected},
+		{"dropped_oldest", slow.DroppedOldest},
+		{"dropped_newest", slow.DroppedNewest},
+		{"conflated", slow.Conflated},
+	} {
+		fmt.Fprintf(bw, "sseserver_slow_consumer_total{outcome=\"%s\"} %d\n", o.outcome, o.n)
+	}
+
+	queueDepth.write(bw, "sseserver_queue_depth",
+		"Messages already queued for a connection when another is queued.", 1)
+	m.latency.write(bw, "sseserver_broadcast_flush_latency_seconds",
+		"Time from a message being broadcast to it being flushed to a connection.", 1e-9)
+}
+
+// labelEscaper escapes the only characters the Prometheus text format requires
+// to be escaped in label values, backslashes, double quotes and line breaks.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the Prometheus text format, for
+// writing between double quotes.
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// Handles serving the metrics in the Prometheus text exposition format
+func adminMetricsHandler(w http.ResponseWriter, r *http.Request, s *Server) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, s)
+}
@@ -0,0 +1,145 @@
+package sseserver
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	hg := newHistogram(1, 10)
+	for _, v := range []uint64{0, 1, 5, 10, 11, 100} {
+		hg.observe(v)
+	}
+	other := newHistogram(1, 10)
+	other.observe(3)
+	hg.merge(other)
+
+	var b strings.Builder
+	hg.write(&b, "test", "Test.", 0.5)
+	expected := `# HELP test Test.
+# TYPE test histogram
+test_bucket{le="0.5"} 2
+test_bucket{le="5"} 5
+test_bucket{le="+Inf"} 7
+test_sum 65
+test_count 7
+`
+	if b.String() != expected {
+		t.Errorf("unexpected output: got\n%s\nwant\n%s", b.String(), expected)
+	}
+}
+
+func TestNamespaceRoot(t *testing.T) {
+	for ns, expected := range map[string]string{
+		"/":              "/",
+		"/pets":          "/pets",
+		"/pets/dogs":     "/pets",
+		"/pets/dogs/":    "/pets",
+		"/pets/*/puppy":  "/pets",
+		"/news/politics": "/news",
+	} {
+		if actual := namespaceRoot(ns); actual != expected {
+			t.Errorf("namespaceRoot(%q): got %q want %q", ns, actual, expected)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	for v, expected := range map[string]string{
+		"/pets":           `/pets`,
+		"/say \"hi\"":     `/say \"hi\"`,
+		`/back\slash`:     `/back\\slash`,
+		"/line\nbreak":    `/line\nbreak`,
+		"/tab\tand\u00e9": "/tab\tand\u00e9", // left alone
+	} {
+		if actual := escapeLabel(v); actual != expected {
+			t.Errorf("escapeLabel(%q): got %q want %q", v, actual, expected)
+		}
+	}
+}
+
+// fetchMetrics returns the metrics from the admin endpoint by name, including
+// any labels, ignoring comments.
+func fetchMetrics(t *testing.T, ts *httptest.Server) map[string]string {
+	t.Helper()
+	res, err := http.Get(ts.URL + "/admin/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type: %q", ct)
+	}
+	metrics := make(map[string]string)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		metrics[line[:i]] = line[i+1:]
+	}
+	return metrics
+}
+
+func TestAdminMetrics(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	defer s.hub.Shutdown()
+
+	dogs := subscribe(t, ts, "/pets/dogs")
+	defer dogs.Body.Close()
+	pets := subscribe(t, ts, "/pets?ns=/pets/cats")
+	defer pets.Body.Close()
+	news := subscribe(t, ts, "/news")
+	defer news.Body.Close()
+
+	s.Broadcast <- SSEMessage{Data: []byte("woof"), Namespace: "/pets/dogs"}
+	frame := "data:woof\n\n"
+	for _, res := range []*http.Response{dogs, pets} {
+		buf := make([]byte, len(frame))
+		if _, err := res.Body.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var metrics map[string]string
+	waitFor(t, "msgs to be counted", func() bool {
+		metrics = fetchMetrics(t, ts)
+		return metrics["sseserver_broadcast_flush_latency_seconds_count"] == "2"
+	})
+	for name, expected := range map[string]string{
+		"sseserver_connections":                                       "3",
+		`sseserver_namespace_connections{namespace_root="/pets"}`:     "2",
+		`sseserver_namespace_connections{namespace_root="/news"}`:     "1",
+		"sseserver_messages_broadcast_total":                          "1",
+		"sseserver_bytes_written_total":                               "22",
+		`sseserver_slow_consumer_total{outcome="disconnected"}`:       "0",
+		`sseserver_queue_depth_bucket{le="+Inf"}`:                     "2",
+		`sseserver_broadcast_flush_latency_seconds_bucket{le="+Inf"}`: "2",
+	} {
+		if metrics[name] != expected {
+			t.Errorf("unexpected %s: got %q want %q", name, metrics[name], expected)
+		}
+	}
+}
+
+func TestMetricsCounters(t *testing.T) {
+	m := newMetrics()
+	m.wroteKeepalive(len(":keepalive\n"))
+	m.wrote(queuedMsg{frame: []byte("data: hi\n\n"), at: time.Now()}, 10)
+	if m.keepalivesSent != 1 || m.bytesWritten != 21 {
+		t.Errorf("unexpected counts: got %d keepalives, %d bytes", m.keepalivesSent, m.bytesWritten)
+	}
+	var b strings.Builder
+	m.latency.write(&b, "latency", "Latency.", 1e-9)
+	if !strings.Contains(b.String(), "latency_count 1\n") {
+		t.Errorf("latency not observed:\n%s", b.String())
+	}
+}
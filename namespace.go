@@ -0,0 +1,214 @@
+package sseserver
+
+import "strings"
+
+// matchNamespace reports whether a subscription to sub encompasses namespace.
+//
+// Namespaces are hierarchical and matched on "/" separated segments, so a
+// subscription matches its own namespace and everything beneath it: "/pets"
+// matches "/pets" and "/pets/cats", but not "/petstore".
+//
+// Subscriptions may also contain wildcard segments: "*" matches any single
+// segment, and "**" matches any number of segments (including none). E.g.
+// "/pets/*/adopted" matches "/pets/cats/adopted" and "/pets/dogs/adopted".
+func matchNamespace(sub, namespace string) bool {
+	sub = strings.TrimSuffix(sub, "/")
+	if sub == "" {
+		return true // root subscription gets everything
+	}
+	if strings.IndexByte(sub, '*') == -1 {
+		// fast path for the overwhelmingly common case, no need to split
+		return strings.HasPrefix(namespace, sub) &&
+			(len(namespace) == len(sub) || namespace[len(sub)] == '/')
+	}
+	return matchSegments(strings.TrimPrefix(sub, "/"), strings.TrimPrefix(namespace, "/"))
+}
+
+// matchSegments matches a wildcard pattern against a namespace, both of which
+// have had their leading slash removed.
+func matchSegments(pattern, namespace string) bool {
+	for pattern != "" {
+		seg, prest := cutSegment(pattern)
+		if seg == "**" {
+			// try consuming increasingly more of the namespace
+			for {
+				if matchSegments(prest, namespace) {
+					return true
+				}
+				if namespace == "" {
+					return false
+				}
+				_, namespace = cutSegment(namespace)
+			}
+		}
+		if namespace == "" {
+			return false
+		}
+		nseg, nrest := cutSegment(namespace)
+		if seg != "*" && seg != nseg {
+			return false
+		}
+		pattern, namespace = prest, nrest
+	}
+	return true
+}
+
+// coversNamespace reports whether a subscription to granted encompasses
+// everything a subscription to requested would, where both may contain
+// wildcards. This is stricter than matchNamespace, which treats the namespace
+// as a literal, so that a wildcard subscription cannot be used to reach beyond
+// what was granted, e.g. "/users/*" covers "/users/alice" and "/users/*", but
+// not "/users/**", which also matches "/users" itself.
+func coversNamespace(granted, requested string) bool {
+	return coverSegments(trimSub(granted), trimSub(requested))
+}
+
+// coverSegments compares the segments of a granted and requested subscription,
+// both of which have been trimmed with trimSub.
+func coverSegments(granted, requested string) bool {
+	for granted != "" {
+		seg, grest := cutSegment(granted)
+		if seg == "**" {
+			// may stand in for any number of requested segments, wildcard or
+			// not, so try consuming increasingly more of them
+			for {
+				if coverSegments(grest, requested) {
+					return true
+				}
+				if requested == "" {
+					return false
+				}
+				_, requested = cutSegment(requested)
+			}
+		}
+		if requested == "" {
+			// the requested subscription includes this namespace itself,
+			// which the granted one does not reach
+			return false
+		}
+		rseg, rrest := cutSegment(requested)
+		switch {
+		case rseg == "**":
+			return false // only a granted "**" covers any number of segments
+		case seg == "*":
+			// covers any single segment, including a requested "*"
+		case rseg == "*" || seg != rseg:
+			return false
+		}
+		granted, requested = grest, rrest
+	}
+	// anything beneath the granted subscription is included
+	return true
+}
+
+// cutSegment splits off the first segment of a slash separated path.
+func cutSegment(s string) (seg, rest string) {
+	if i := strings.IndexByte(s, '/'); i != -1 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// nsIndex is a trie of subscriptions keyed on namespace segments, allowing a
+// shard to find the connections subscribed to a namespace without examining
+// every connection. It follows the same matching rules as matchNamespace.
+//
+// An nsIndex is not safe for concurrent use, each shard owns its own, which is
+// only accessed from the shard's run loop.
+type nsIndex struct {
+	root *nsNode
+}
+
+type nsNode struct {
+	children map[string]*nsNode
+	conns    map[*connection]struct{} // subscriptions ending at this node
+}
+
+func newNSIndex() *nsIndex {
+	return &nsIndex{root: &nsNode{}}
+}
+
+// trimSub normalizes a subscription or namespace for walking the trie.
+func trimSub(ns string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(ns, "/"), "/")
+}
+
+// add indexes a subscription to sub for connection c.
+func (ix *nsIndex) add(sub string, c *connection) {
+	n := ix.root
+	for rest := trimSub(sub); rest != ""; {
+		var seg string
+		seg, rest = cutSegment(rest)
+		child, ok := n.children[seg]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*nsNode)
+			}
+			child = &nsNode{}
+			n.children[seg] = child
+		}
+		n = child
+	}
+	if n.conns == nil {
+		n.conns = make(map[*connection]struct{})
+	}
+	n.conns[c] = struct{}{}
+}
+
+// remove removes a subscription to sub for connection c, pruning any nodes
+// which are no longer needed.
+func (ix *nsIndex) remove(sub string, c *connection) {
+	ix.root.remove(trimSub(sub), c)
+}
+
+// remove returns whether n is now empty and can be pruned by its parent.
+func (n *nsNode) remove(rest string, c *connection) bool {
+	if rest == "" {
+		delete(n.conns, c)
+	} else {
+		seg, rest := cutSegment(rest)
+		if child, ok := n.children[seg]; ok && child.remove(rest, c) {
+			delete(n.children, seg)
+		}
+	}
+	return len(n.conns) == 0 && len(n.children) == 0
+}
+
+// match calls fn for each connection with a subscription matching namespace.
+// fn may be called more than once for the same connection, if it has multiple
+// matching subscriptions or wildcards allow a subscription to match in more
+// than one way, so callers must dedupe.
+func (ix *nsIndex) match(namespace string, fn func(c *connection)) {
+	ix.root.match(strings.TrimPrefix(namespace, "/"), fn)
+}
+
+func (n *nsNode) match(rest string, fn func(c *connection)) {
+	// namespaces are hierarchical, so reaching a node at all means everything
+	// subscribed here matches.
+	for c := range n.conns {
+		fn(c)
+	}
+	if len(n.children) == 0 {
+		return
+	}
+	if child, ok := n.children["**"]; ok {
+		// try consuming increasingly more of the namespace
+		for r := rest; ; {
+			child.match(r, fn)
+			if r == "" {
+				break
+			}
+			_, r = cutSegment(r)
+		}
+	}
+	if rest == "" {
+		return
+	}
+	seg, rest := cutSegment(rest)
+	if child, ok := n.children[seg]; ok {
+		child.match(rest, fn)
+	}
+	if child, ok := n.children["*"]; ok && seg != "*" {
+		child.match(rest, fn)
+	}
+}
@@ -0,0 +1,131 @@
+package sseserver
+
+import "testing"
+
+var namespaceTests = []struct {
+	sub, namespace string
+	expected       bool
+}{
+	{"/pets", "/pets", true},
+	{"/pets", "/pets/cats", true},
+	{"/pets", "/pets/cats/lolcat", true},
+	{"/pets/", "/pets/cats", true},
+	{"/pet", "/pets", false},
+	{"/pet", "/pets/cats", false},
+	{"/pets", "/petstore", false},
+	{"/pets/cats", "/pets", false},
+	{"/", "/pets", true},
+	{"/", "", true},
+	{"", "/pets", true},
+	{"/pets/*/adopted", "/pets/cats/adopted", true},
+	{"/pets/*/adopted", "/pets/dogs/adopted/rex", true},
+	{"/pets/*/adopted", "/pets/dogs/new", false},
+	{"/pets/*/adopted", "/pets/adopted", false},
+	{"/pets/*", "/pets", false},
+	{"/pets/*", "/pets/cats", true},
+	{"/*/cats", "/pets/cats", true},
+	{"/*/cats", "/wild/cats", true},
+	{"/*/cats", "/pets/dogs", false},
+	{"/pets/**", "/pets", true},
+	{"/pets/**", "/pets/cats/lolcat", true},
+	{"/pets/**", "/petstore", false},
+	{"/pets/**/adopted", "/pets/adopted", true},
+	{"/pets/**/adopted", "/pets/cats/lolcat/adopted", true},
+	{"/pets/**/adopted", "/pets/cats/lolcat/new", false},
+	{"/**/adopted", "/pets/cats/adopted", true},
+	{"/pets/c*", "/pets/cats", false}, // wildcards are only whole segments
+}
+
+func TestMatchNamespace(t *testing.T) {
+	for _, nt := range namespaceTests {
+		if actual := matchNamespace(nt.sub, nt.namespace); actual != nt.expected {
+			t.Errorf("matchNamespace(%q, %q): got %v want %v",
+				nt.sub, nt.namespace, actual, nt.expected)
+		}
+	}
+}
+
+func TestCoversNamespace(t *testing.T) {
+	for _, ct := range []struct {
+		granted, requested string
+		expected           bool
+	}{
+		{"/", "/users/**", true},
+		{"/users", "/users", true},
+		{"/users", "/users/*/private", true},
+		{"/users", "/", false},
+		{"/users/*", "/users/alice", true},
+		{"/users/*", "/users/alice/inbox", true},
+		{"/users/*", "/users/*", true},
+		{"/users/*", "/users", false},
+		{"/users/*", "/users/**", false}, // would also match "/users"
+		{"/users/*/private", "/users/alice/private", true},
+		{"/users/*/private", "/users/*/private", true},
+		{"/users/*/private", "/users/**/private", false}, // would match "/users/a/b/private"
+		{"/users/*/private", "/users/alice/public", false},
+		{"/users/alice", "/users/*", false},
+		{"/users/**", "/users", true},
+		{"/users/**", "/users/**", true},
+		{"/users/**/private", "/users/**/private", true},
+		{"/users/**/private", "/users/*/x/private", true},
+		{"/users/**/private", "/users/**", false},
+	} {
+		if actual := coversNamespace(ct.granted, ct.requested); actual != ct.expected {
+			t.Errorf("coversNamespace(%q, %q): got %v want %v",
+				ct.granted, ct.requested, actual, ct.expected)
+		}
+	}
+}
+
+// the index should agree with matchNamespace in all cases
+func TestNSIndexMatch(t *testing.T) {
+	for _, nt := range namespaceTests {
+		ix := newNSIndex()
+		c := mockConn(nt.sub)
+		ix.add(nt.sub, c)
+		ix.add("/unrelated", mockConn("/unrelated"))
+
+		var actual bool
+		ix.match(nt.namespace, func(m *connection) {
+			if m == c {
+				actual = true
+			}
+		})
+		if actual != nt.expected {
+			t.Errorf("index match(%q, %q): got %v want %v",
+				nt.sub, nt.namespace, actual, nt.expected)
+		}
+	}
+}
+
+// removing the last subscription beneath a node should prune it
+func TestNSIndexRemove(t *testing.T) {
+	ix := newNSIndex()
+	c1, c2 := mockConn("/pets/cats"), mockConn("/pets")
+	ix.add("/pets/cats", c1)
+	ix.add("/pets", c2)
+
+	ix.remove("/pets/cats", c1)
+	if pets := ix.root.children["pets"]; pets == nil || len(pets.children) != 0 {
+		t.Error("expected /pets/cats node to be pruned, leaving /pets")
+	}
+	ix.remove("/pets", c2)
+	ix.remove("/pets", c2) // no-op
+	ix.remove("/never/added", c2)
+	if len(ix.root.children) != 0 {
+		t.Errorf("expected empty index, got %d children", len(ix.root.children))
+	}
+}
+
+func BenchmarkMatchNamespace(b *testing.B) {
+	b.Run("prefix", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			matchNamespace("/pets/cats", "/pets/cats/lolcat")
+		}
+	})
+	b.Run("wildcard", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			matchNamespace("/pets/**/adopted", "/pets/cats/lolcat/adopted")
+		}
+	})
+}
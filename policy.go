@@ -0,0 +1,161 @@
+package sseserver
+
+import (
+	"strings"
+	"time"
+)
+
+// SlowConsumerPolicy determines what happens when a message is broadcast to a
+// connection whose send buffer is already full, typically because the client
+// is not reading from its socket fast enough.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDefault defers to the Server's policy, which itself defaults
+	// to SlowConsumerDisconnect.
+	SlowConsumerDefault SlowConsumerPolicy = iota
+	// SlowConsumerDisconnect immediately disconnects the connection, the
+	// client will be expected to reconnect (and possibly resume).
+	SlowConsumerDisconnect
+	// SlowConsumerDropOldest discards the oldest queued message to make room
+	// for the new one.
+	SlowConsumerDropOldest
+	// SlowConsumerDropNewest discards the new message, leaving the queue as is.
+	SlowConsumerDropNewest
+	// SlowConsumerConflate discards everything queued in favour of the new
+	// message, for streams where only the latest value matters.
+	SlowConsumerConflate
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case SlowConsumerDefault:
+		return "default"
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	case SlowConsumerDropOldest:
+		return "drop-oldest"
+	case SlowConsumerDropNewest:
+		return "drop-newest"
+	case SlowConsumerConflate:
+		return "conflate"
+	}
+	return "unknown"
+}
+
+// SlowConsumerStats counts the outcomes of applying a SlowConsumerPolicy.
+type SlowConsumerStats struct {
+	Disconnected  uint64 `json:"disconnected"`   // connections disconnected
+	DroppedOldest uint64 `json:"dropped_oldest"` // queued msgs discarded
+	DroppedNewest uint64 `json:"dropped_newest"` // new msgs discarded
+	Conflated     uint64 `json:"conflated"`      // queued msgs discarded by conflation
+}
+
+func (s *SlowConsumerStats) add(o SlowConsumerStats) {
+	s.Disconnected += o.Disconnected
+	s.DroppedOldest += o.DroppedOldest
+	s.DroppedNewest += o.DroppedNewest
+	s.Conflated += o.Conflated
+}
+
+// NamespaceOptions are options which can be customized for a namespace (and
+// its children), overriding the Server-wide setting.
+//
+// The zero value for any field means to use the Server-wide setting.
+type NamespaceOptions struct {
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	// KeepaliveInterval and KeepalivePayload for connections subscribed to
+	// the namespace. A connection subscribed to multiple namespaces uses the
+	// shortest interval of any of them, and the payload of the first.
+	KeepaliveInterval time.Duration
+	KeepalivePayload  string
+}
+
+// namespaceOptions returns the NamespaceOptions for the most specific entry in
+// o.Namespaces which matches namespace.
+func (o *ServerOptions) namespaceOptions(namespace string) NamespaceOptions {
+	var (
+		best    NamespaceOptions
+		bestLen = -1
+	)
+	for ns, nsOpts := range o.Namespaces {
+		if len(ns) > bestLen && matchNamespace(ns, namespace) {
+			best, bestLen = nsOpts, len(ns)
+		}
+	}
+	return best
+}
+
+// slowConsumerPolicy returns the effective SlowConsumerPolicy for messages
+// broadcast to namespace.
+func (o *ServerOptions) slowConsumerPolicy(namespace string) SlowConsumerPolicy {
+	if p := o.namespaceOptions(namespace).SlowConsumerPolicy; p != SlowConsumerDefault {
+		return p
+	}
+	if o.SlowConsumerPolicy != SlowConsumerDefault {
+		return o.SlowConsumerPolicy
+	}
+	return SlowConsumerDisconnect
+}
+
+// connBufferSize returns the size of the send buffer for new connections.
+func (o *ServerOptions) connBufferSize() int {
+	if o.ConnectionBufferSize > 0 {
+		return o.ConnectionBufferSize
+	}
+	return connBufSize
+}
+
+// stalled reports whether a connection which has been unable to keep up since
+// the time given has exceeded the SlowConsumerTimeout.
+func (o *ServerOptions) stalled(since time.Time) bool {
+	return o.SlowConsumerTimeout > 0 && time.Since(since) > o.SlowConsumerTimeout
+}
+
+// keepalive returns the interval between keepalives for a connection
+// subscribed to namespaces, and the formatted keepalive to send.
+func (o *ServerOptions) keepalive(namespaces []string) (time.Duration, []byte) {
+	defaultInterval := o.KeepaliveInterval
+	if defaultInterval <= 0 {
+		defaultInterval = keepaliveInterval
+	}
+	var (
+		interval time.Duration
+		payload  string
+	)
+	for _, ns := range namespaces {
+		nsOpts := o.namespaceOptions(ns)
+		d := nsOpts.KeepaliveInterval
+		if d <= 0 {
+			d = defaultInterval
+		}
+		if interval == 0 || d < interval {
+			interval = d
+		}
+		if payload == "" {
+			payload = nsOpts.KeepalivePayload
+		}
+	}
+	if interval == 0 {
+		interval = defaultInterval
+	}
+	if payload == "" {
+		payload = o.KeepalivePayload
+	}
+	if payload == "" {
+		payload = keepalivePayload
+	}
+
+	if o.KeepaliveEvent != "" {
+		return interval, SSEMessage{Event: o.KeepaliveEvent, Data: []byte(payload)}.sseFormat()
+	}
+	// any line beginning with a colon is a comment, and ignored by the client
+	var b []byte
+	for _, line := range strings.Split(strings.Replace(payload, "\r", "", -1), "\n") {
+		b = append(b, ':')
+		b = append(b, line...)
+		b = append(b, '\n')
+	}
+	return interval, b
+}
@@ -0,0 +1,154 @@
+package sseserver
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultPresenceInterval is how often presence events are sent, at most.
+const defaultPresenceInterval = time.Second
+
+// presenceKey returns the canonical form of a namespace for counting presence,
+// with a leading and without a trailing "/".
+func presenceKey(namespace string) string {
+	return "/" + trimSub(namespace)
+}
+
+// namespaceAncestors calls fn for namespace and each of its parents, up to and
+// including the root "/".
+func namespaceAncestors(namespace string, fn func(ns string)) {
+	ns := presenceKey(namespace)
+	for ns != "/" {
+		fn(ns)
+		ns = ns[:strings.LastIndexByte(ns, '/')]
+		if ns == "" {
+			ns = "/"
+		}
+	}
+	fn("/")
+}
+
+// presenceTracker counts the connections subscribed to each namespace or
+// beneath it, and which counts have changed since presence events were last
+// sent.
+//
+// A presenceTracker is not safe for concurrent use, it is owned by the hub run
+// loop.
+type presenceTracker struct {
+	counts  map[string]int
+	sent    map[string]int  // counts last sent in presence events
+	dirty   map[string]bool // namespaces whose count has changed since
+	pending bool            // a flush has been scheduled
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		counts: make(map[string]int),
+		sent:   make(map[string]int),
+		dirty:  make(map[string]bool),
+	}
+}
+
+// update adjusts the counts for all namespaces a connection counts towards by
+// delta. A connection subscribed to several namespaces beneath a parent only
+// counts once towards the parent. The namespaces affected are only marked as
+// changed if track is set, as otherwise nothing would ever reset them.
+func (p *presenceTracker) update(c *connection, delta int, track bool) {
+	seen := make(map[string]bool)
+	for _, sub := range c.namespaces {
+		namespaceAncestors(sub, func(ns string) {
+			if seen[ns] {
+				return
+			}
+			seen[ns] = true
+			if p.counts[ns] += delta; p.counts[ns] <= 0 {
+				delete(p.counts, ns)
+			}
+			if track {
+				p.dirty[ns] = true
+			}
+		})
+	}
+}
+
+// changes returns a presence event for each namespace whose count differs from
+// that last sent, ordered by namespace, and resets the changes.
+func (p *presenceTracker) changes() []SSEMessage {
+	var msgs []SSEMessage
+	for ns := range p.dirty {
+		delete(p.dirty, ns)
+		count := p.counts[ns]
+		if sent, ok := p.sent[ns]; ok && sent == count || !ok && count == 0 {
+			continue
+		}
+		if count == 0 {
+			delete(p.sent, ns)
+		} else {
+			p.sent[ns] = count
+		}
+		data, _ := json.Marshal(struct {
+			Namespace string `json:"namespace"`
+			Count     int    `json:"count"`
+		}{ns, count})
+		msgs = append(msgs, SSEMessage{Event: "presence", Data: data, Namespace: ns})
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Namespace < msgs[j].Namespace })
+	return msgs
+}
+
+// internal method, adjusts presence for a connection being registered (delta
+// 1) or unregistered (delta -1), scheduling presence events if enabled.
+func (h *hub) _updatePresence(c *connection, delta int) {
+	h.presence.update(c, delta, h.opts.PresenceEvents)
+	if !h.opts.PresenceEvents || h.presence.pending {
+		return
+	}
+	h.presence.pending = true
+	interval := h.opts.PresenceInterval
+	if interval <= 0 {
+		interval = defaultPresenceInterval
+	}
+	time.AfterFunc(interval, func() {
+		select {
+		case h.presenceFlush <- struct{}{}:
+		case <-h.done:
+		}
+	})
+}
+
+// internal method, sends presence events for any namespaces whose count has
+// changed. They go only to our own clients, as counts are per node, and are not
+// retained for replay.
+func (h *hub) _flushPresence() {
+	h.presence.pending = false
+	for _, msg := range h.presence.changes() {
+		h._fanoutMessage(msg, msg.sseFormat(), nil)
+	}
+}
+
+// Presence returns the number of connections subscribed to namespace, or to
+// any namespace beneath it. For example, the presence for "/pets" includes
+// connections subscribed to "/pets/dogs".
+//
+// Returns zero once the Server has been Shutdown.
+func (s *Server) Presence(namespace string) int {
+	var n int
+	s.hub.runQuery(&shardQuery{hubFn: func(h *hub) {
+		n = h.presence.counts[presenceKey(namespace)]
+	}})
+	return n
+}
+
+// PresenceCounts returns the Presence for every namespace which has any, keyed
+// by namespace.
+func (s *Server) PresenceCounts() map[string]int {
+	counts := make(map[string]int)
+	s.hub.runQuery(&shardQuery{hubFn: func(h *hub) {
+		for ns, n := range h.presence.counts {
+			counts[ns] = n
+		}
+	}})
+	return counts
+}
@@ -0,0 +1,99 @@
+package sseserver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNamespaceAncestors(t *testing.T) {
+	var ancestorTests = []struct {
+		namespace string
+		expected  []string
+	}{
+		{"/pets/dogs/corgi", []string{"/pets/dogs/corgi", "/pets/dogs", "/pets", "/"}},
+		{"/pets/", []string{"/pets", "/"}},
+		{"pets", []string{"/pets", "/"}},
+		{"/", []string{"/"}},
+		{"", []string{"/"}},
+	}
+	for _, tc := range ancestorTests {
+		var actual []string
+		namespaceAncestors(tc.namespace, func(ns string) { actual = append(actual, ns) })
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("namespaceAncestors(%q): got %q want %q", tc.namespace, actual, tc.expected)
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	s := NewServer()
+	defer s.hub.Shutdown()
+	both := mockConn("/pets/dogs")
+	both.namespaces = append(both.namespaces, "/pets/cats")
+	for _, c := range []*connection{mockConn("/pets/dogs"), mockConn("/pets/cats"), both, mockConn("/time")} {
+		s.hub.register <- c
+	}
+
+	var presenceTests = []struct {
+		namespace string
+		expected  int
+	}{
+		{"/pets", 3},
+		{"/pets/", 3},
+		{"/pets/dogs", 2},
+		{"/pets/dogs/corgi", 0},
+		{"/", 4},
+	}
+	for _, tc := range presenceTests {
+		if actual := s.Presence(tc.namespace); actual != tc.expected {
+			t.Errorf("Presence(%q): got %d want %d", tc.namespace, actual, tc.expected)
+		}
+	}
+
+	s.hub.unregister <- both
+	expected := map[string]int{"/": 3, "/pets": 2, "/pets/dogs": 1, "/pets/cats": 1, "/time": 1}
+	if actual := s.PresenceCounts(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected counts after unregister: got %v want %v", actual, expected)
+	}
+
+	// without presence events, nothing should be kept to send them
+	s.hub.runQuery(&shardQuery{hubFn: func(h *hub) {
+		if n := len(h.presence.dirty); n != 0 {
+			t.Errorf("unexpected dirty namespaces without presence events: got %d want 0", n)
+		}
+	}})
+}
+
+// changes in presence should be broadcast, debounced, into the namespaces
+// affected.
+func TestPresenceEvents(t *testing.T) {
+	h := mockHub(0)
+	defer h.Shutdown()
+	h.opts.PresenceEvents = true
+	h.opts.PresenceInterval = 50 * time.Millisecond
+
+	watcher := mockConn("/pets")
+	dog1, dog2 := mockConn("/pets/dogs"), mockConn("/pets/dogs")
+	h.register <- watcher
+	h.register <- dog1
+	h.register <- dog2
+	for _, expected := range []string{
+		"event:presence\ndata:{\"namespace\":\"/pets\",\"count\":3}\n\n",
+		"event:presence\ndata:{\"namespace\":\"/pets/dogs\",\"count\":2}\n\n",
+	} {
+		if actual := receive(t, watcher); actual != expected {
+			t.Errorf("unexpected presence event: got %q want %q", actual, expected)
+		}
+	}
+	receive(t, dog1)
+
+	// no event if the count ends up unchanged
+	h.unregister <- dog2
+	h.register <- dog2
+	time.Sleep(3 * h.opts.PresenceInterval)
+	h.inspect(func(*shard) {})
+	if n := len(watcher.send); n != 0 {
+		t.Errorf("unexpected presence events for unchanged count: %q", (<-watcher.send).frame)
+	}
+}
@@ -0,0 +1,143 @@
+package sseserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// publishMaxBodySize is the largest request the publish endpoint will accept.
+const publishMaxBodySize = 16 << 20
+
+// publishedMessage is a message as sent to the publish endpoint.
+type publishedMessage struct {
+	Event string `json:"event"`
+	ID    string `json:"id"`
+	// Data is usually a string, but may be any JSON value, in which case it
+	// is sent on as is.
+	Data json.RawMessage `json:"data"`
+}
+
+func (pm publishedMessage) sseMessage(namespace string) (SSEMessage, error) {
+	msg := SSEMessage{Event: pm.Event, ID: pm.ID, Namespace: namespace}
+	if len(pm.Data) > 0 && pm.Data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(pm.Data, &s); err != nil {
+			return msg, err
+		}
+		msg.Data = []byte(s)
+	} else if !bytes.Equal(pm.Data, []byte("null")) {
+		msg.Data = []byte(pm.Data)
+	}
+	return msg, nil
+}
+
+// publishSummary is the response from the publish endpoint, with the
+// DeliveryReport of every message published summed together.
+type publishSummary struct {
+	Published int `json:"published"`
+	DeliveryReport
+}
+
+// readPublishedMessages decodes the body of a request to the publish endpoint,
+// either a single JSON message when the Content-Type is "application/json", or
+// when it is "application/x-ndjson", any number of them one per line.
+func readPublishedMessages(w http.ResponseWriter, r *http.Request, namespace string) ([]SSEMessage, error) {
+	body := http.MaxBytesReader(w, r.Body, publishMaxBodySize)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "application/x-ndjson" {
+		var pm publishedMessage
+		if err := json.NewDecoder(body).Decode(&pm); err != nil {
+			return nil, fmt.Errorf("malformed message: %v", err)
+		}
+		msg, err := pm.sseMessage(namespace)
+		if err != nil {
+			return nil, fmt.Errorf("malformed message: %v", err)
+		}
+		return []SSEMessage{msg}, nil
+	}
+
+	var msgs []SSEMessage
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, publishMaxBodySize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var pm publishedMessage
+		err := json.Unmarshal(scanner.Bytes(), &pm)
+		if err == nil {
+			var msg SSEMessage
+			if msg, err = pm.sseMessage(namespace); err == nil {
+				msgs = append(msgs, msg)
+				continue
+			}
+		}
+		return nil, fmt.Errorf("malformed message on line %d: %v", line, err)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// publishHandler handles requests to publish messages, for producers which are
+// unable to use Broadcast or Publish directly. The namespace is the request
+// path, see readPublishedMessages for the body.
+func publishHandler(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizer := s.Options.PublishAuthorizer
+		if authorizer == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// requiring a JSON Content-Type, which no form can send and scripts
+		// can only send to other origins with CORS, stops other web pages
+		// publishing on behalf of whoever is visiting them
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" && ct != "application/x-ndjson" {
+			http.Error(w, "415 unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		namespace := r.URL.Path
+		if namespace == "" {
+			namespace = "/"
+		}
+		if auth := authorizer.Authorize(r, namespace); auth.Deny {
+			auth.deny(w)
+			return
+		}
+
+		msgs, err := readPublishedMessages(w, r, namespace)
+		if err != nil {
+			http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var summary publishSummary
+		for _, msg := range msgs {
+			report, err := s.Publish(r.Context(), msg)
+			if err == ErrServerClosed {
+				http.Error(w, "503 server shutting down", http.StatusServiceUnavailable)
+				return
+			} else if err != nil {
+				return // client went away, nobody to tell
+			}
+			summary.Published++
+			summary.add(report)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		b, _ := json.MarshalIndent(summary, "", "  ")
+		fmt.Fprint(w, string(b))
+	})
+}
@@ -0,0 +1,125 @@
+package sseserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// post sends body to the publish endpoint, returning the response status and
+// body.
+func post(t *testing.T, ts *httptest.Server, path, contentType, key, body string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", ts.URL+"/publish"+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(b)
+}
+
+var testPublishAuthorizer = AuthorizerFunc(func(r *http.Request, namespace string) Authorization {
+	if requestToken(r) != "hunter2" {
+		return Authorization{Deny: true, Status: http.StatusUnauthorized}
+	}
+	return Authorization{}
+})
+
+func TestPublishEndpoint(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	defer s.hub.Shutdown()
+
+	// disabled by default
+	if status, _ := post(t, ts, "/pets", "application/json", "", `{"data":"woof"}`); status != http.StatusNotFound {
+		t.Errorf("unexpected status when disabled: got %v want %v", status, http.StatusNotFound)
+	}
+	s.Options.PublishAuthorizer = testPublishAuthorizer
+
+	c := mockConn("/pets")
+	s.hub.register <- c
+
+	status, body := post(t, ts, "/pets/dogs", "application/json", "hunter2",
+		`{"event":"new-dog","id":"1","data":"woof"}`)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status: got %v want %v: %s", status, http.StatusOK, body)
+	}
+	var summary publishSummary
+	if err := json.Unmarshal([]byte(body), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (publishSummary{1, DeliveryReport{Matched: 1, Queued: 1}}); summary != expected {
+		t.Errorf("unexpected summary: got %+v want %+v", summary, expected)
+	}
+	if msg, expected := receive(t, c), "id:1\nevent:new-dog\ndata:woof\n\n"; msg != expected {
+		t.Errorf("unexpected msg: got %q want %q", msg, expected)
+	}
+
+	status, body = post(t, ts, "/pets", "application/x-ndjson", "hunter2",
+		"{\"data\":\"one\"}\n\n{\"data\":{\"n\":2}}\n")
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status: got %v want %v: %s", status, http.StatusOK, body)
+	}
+	if err := json.Unmarshal([]byte(body), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (publishSummary{2, DeliveryReport{Matched: 2, Queued: 2}}); summary != expected {
+		t.Errorf("unexpected summary: got %+v want %+v", summary, expected)
+	}
+	for _, expected := range []string{"data:one\n\n", "data:{\"n\":2}\n\n"} {
+		if msg := receive(t, c); msg != expected {
+			t.Errorf("unexpected msg: got %q want %q", msg, expected)
+		}
+	}
+}
+
+func TestPublishEndpointErrors(t *testing.T) {
+	s := NewServer()
+	s.Options.PublishAuthorizer = testPublishAuthorizer
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	defer s.hub.Shutdown()
+
+	for _, tc := range []struct {
+		key, contentType, body string
+		status                 int
+		response               string // expected prefix
+	}{
+		{"", "application/json", `{"data":"woof"}`, http.StatusUnauthorized, "401 unauthorized"},
+		{"hunter2", "application/json", `{"data":`, http.StatusBadRequest, "400 malformed message:"},
+		{"hunter2", "text/plain", `{"data":"woof"}`, http.StatusUnsupportedMediaType, "415 unsupported media type"},
+		{"hunter2", "application/x-www-form-urlencoded", `{"data":"woof"}`, http.StatusUnsupportedMediaType,
+			"415 unsupported media type"},
+		{"hunter2", "application/x-ndjson", "{\"data\":\"ok\"}\nnope\n", http.StatusBadRequest,
+			"400 malformed message on line 2:"},
+	} {
+		status, response := post(t, ts, "/pets", tc.contentType, tc.key, tc.body)
+		if status != tc.status || !strings.HasPrefix(response, tc.response) {
+			t.Errorf("posting %q: got %v %q want %v %q", tc.body, status, response, tc.status, tc.response)
+		}
+	}
+
+	res, err := http.Get(ts.URL + "/publish/pets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status for GET: got %v want %v", res.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	// nothing from a bad batch should have been published
+	if sent := s.Status().SentMsgs; sent != 0 {
+		t.Errorf("unexpected msgs_broadcast: got %d want 0", sent)
+	}
+}
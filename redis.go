@@ -0,0 +1,416 @@
+package sseserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azer/debug"
+)
+
+const (
+	redisQueueSize    = 1024             // msgs queued while Redis is slow or unreachable
+	redisDialTimeout  = 5 * time.Second  // how long to wait connecting to Redis
+	redisWriteTimeout = 10 * time.Second // how long to wait writing to Redis
+	redisReadTimeout  = 10 * time.Second // how long to wait for a reply
+	redisPingInterval = 30 * time.Second // how long a connection may be idle before checking it
+	redisMinBackoff   = 100 * time.Millisecond
+	redisMaxBackoff   = 5 * time.Second
+)
+
+// RedisOptions configures a RedisBackplane.
+type RedisOptions struct {
+	Addr     string // host:port of the Redis server
+	Password string // sent with AUTH if set
+
+	// ChannelPrefix is prepended to a message's namespace to form the Redis
+	// channel it is published on, e.g. "sseserver:/pets/dogs". All nodes must
+	// use the same prefix. Defaults to "sseserver:".
+	ChannelPrefix string
+}
+
+// RedisBackplane is a Backplane which shares messages between nodes via Redis
+// pub/sub, publishing each message to a channel named for its namespace, and
+// subscribing to all of them with PSUBSCRIBE.
+//
+// The connections to Redis are re-established automatically should they be
+// lost, however messages published by other nodes in the meantime will be
+// missed, as Redis does not retain them. Messages published while unable to
+// reach Redis are queued, and dropped if the queue fills up. Idle connections
+// are checked with a PING, so that those lost without being closed, such as
+// after a failover, are noticed too.
+type RedisBackplane struct {
+	opts         RedisOptions
+	pingInterval time.Duration // for testing
+	readTimeout  time.Duration // for testing
+	queue        chan BackplaneMessage
+	incoming     chan BackplaneMessage
+	quit         chan struct{}
+	wg           sync.WaitGroup // publisher and subscriber
+
+	mu           sync.Mutex // Guards everything below
+	closed       bool
+	conns        map[net.Conn]bool // open connections, closed on Close
+	pubConnected bool
+	subConnected bool
+	reconnects   uint64
+	dropped      uint64
+	lastErr      error
+}
+
+// NewRedisBackplane creates a RedisBackplane and begins connecting to Redis in
+// the background, see Status for the state of the connection.
+func NewRedisBackplane(opts RedisOptions) *RedisBackplane {
+	return newRedisBackplane(opts, redisPingInterval, redisReadTimeout)
+}
+
+func newRedisBackplane(opts RedisOptions, pingInterval, readTimeout time.Duration) *RedisBackplane {
+	if opts.ChannelPrefix == "" {
+		opts.ChannelPrefix = "sseserver:"
+	}
+	b := &RedisBackplane{
+		opts:         opts,
+		pingInterval: pingInterval,
+		readTimeout:  readTimeout,
+		queue:        make(chan BackplaneMessage, redisQueueSize),
+		incoming:     make(chan BackplaneMessage, redisQueueSize),
+		quit:         make(chan struct{}),
+		conns:        make(map[net.Conn]bool),
+	}
+	b.wg.Add(2)
+	go b.publisher()
+	go b.subscriber()
+	return b
+}
+
+// Publish queues a message to be published to Redis.
+func (b *RedisBackplane) Publish(msg BackplaneMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBackplaneClosed
+	}
+	select {
+	case b.queue <- msg:
+	default:
+		b.dropped++
+		debug.Debug("redis publish queue is full, dropping msg")
+	}
+	return nil
+}
+
+// Messages returns the channel on which messages from other nodes are received.
+func (b *RedisBackplane) Messages() <-chan BackplaneMessage {
+	return b.incoming
+}
+
+// Close disconnects from Redis, discarding any queued messages.
+func (b *RedisBackplane) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.quit)
+	for c := range b.conns {
+		c.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	close(b.incoming)
+	return nil
+}
+
+// Status reports the state of the connections to Redis.
+func (b *RedisBackplane) Status() BackplaneStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BackplaneStatus{
+		Type:       "redis",
+		Connected:  b.pubConnected && b.subConnected,
+		Reconnects: b.reconnects,
+		Dropped:    b.dropped,
+	}
+	if b.lastErr != nil {
+		s.LastError = b.lastErr.Error()
+	}
+	return s
+}
+
+// publisher publishes queued messages, until closed.
+func (b *RedisBackplane) publisher() {
+	defer b.wg.Done()
+	var pending *BackplaneMessage // msg which failed to publish, to retry
+	b.connectLoop(&b.pubConnected, func(rc *respConn) error {
+		ping := time.NewTicker(b.pingInterval)
+		defer ping.Stop()
+		for {
+			if pending == nil {
+				select {
+				case msg := <-b.queue:
+					pending = &msg
+				case <-ping.C:
+					if _, err := rc.do("PING"); err != nil {
+						return err
+					}
+					continue
+				case <-b.quit:
+					return nil
+				}
+			}
+			payload, err := json.Marshal(pending)
+			if err != nil {
+				debug.Debug("unable to encode msg for redis: " + err.Error())
+				pending = nil
+				continue
+			}
+			channel := b.opts.ChannelPrefix + pending.Message.Namespace
+			if _, err := rc.do("PUBLISH", channel, string(payload)); err != nil {
+				return err
+			}
+			pending = nil
+		}
+	})
+}
+
+// subscriber receives messages from all namespace channels, until closed.
+func (b *RedisBackplane) subscriber() {
+	defer b.wg.Done()
+	b.connectLoop(&b.subConnected, func(rc *respConn) error {
+		if err := rc.send("PSUBSCRIBE", b.opts.ChannelPrefix+"*"); err != nil {
+			return err
+		}
+		pinged := false // and waiting for the reply
+		for {
+			wait := b.pingInterval
+			if pinged {
+				wait = b.readTimeout
+			}
+			if err := rc.wait(wait); err != nil {
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() || pinged {
+					return err
+				}
+				if err := rc.send("PING"); err != nil {
+					return err
+				}
+				pinged = true
+				continue
+			}
+			pinged = false
+			reply, err := rc.receive()
+			if err != nil {
+				return err
+			}
+			parts, ok := reply.([]interface{})
+			if !ok || len(parts) != 4 || parts[0] != "pmessage" {
+				continue // e.g. the psubscribe confirmation, or a pong
+			}
+			channel, _ := parts[2].(string)
+			payload, _ := parts[3].(string)
+			var msg BackplaneMessage
+			if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+				debug.Debug("ignoring malformed msg from redis: " + err.Error())
+				continue
+			}
+			// the channel is authoritative for which namespace a msg is in
+			msg.Message.Namespace = strings.TrimPrefix(channel, b.opts.ChannelPrefix)
+			select {
+			case b.incoming <- msg:
+			case <-b.quit:
+				return nil
+			}
+		}
+	})
+}
+
+// connectLoop repeatedly connects to Redis and calls fn with the connection,
+// until the backplane is closed. connected is set for the lifetime of each
+// connection, which is closed once fn returns.
+func (b *RedisBackplane) connectLoop(connected *bool, fn func(rc *respConn) error) {
+	backoff := redisMinBackoff
+	for {
+		rc, err := b.dial()
+		if err == nil {
+			backoff = redisMinBackoff
+			b.mu.Lock()
+			*connected = true
+			b.mu.Unlock()
+			err = fn(rc)
+			b.mu.Lock()
+			*connected = false
+			delete(b.conns, rc.c)
+			b.mu.Unlock()
+			rc.c.Close()
+		}
+
+		select {
+		case <-b.quit:
+			return
+		default:
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		debug.Debug("redis connection failed: " + err.Error())
+		b.mu.Lock()
+		b.lastErr = err
+		b.reconnects++
+		b.mu.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-b.quit:
+			return
+		}
+		if backoff *= 2; backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+	}
+}
+
+// dial opens and authenticates a new connection to Redis, which is tracked so
+// that it can be closed by Close.
+func (b *RedisBackplane) dial() (*respConn, error) {
+	c, err := net.DialTimeout("tcp", b.opts.Addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		c.Close()
+		return nil, ErrBackplaneClosed
+	}
+	b.conns[c] = true
+	b.mu.Unlock()
+
+	rc := newRespConn(c, b.readTimeout)
+	if b.opts.Password != "" {
+		if _, err := rc.do("AUTH", b.opts.Password); err != nil {
+			b.mu.Lock()
+			delete(b.conns, c)
+			b.mu.Unlock()
+			c.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// respConn is a minimal client for the Redis serialization protocol (RESP),
+// supporting just enough for pub/sub.
+type respConn struct {
+	c       net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration // for reading a reply
+}
+
+func newRespConn(c net.Conn, timeout time.Duration) *respConn {
+	return &respConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c), timeout: timeout}
+}
+
+// do sends a command and returns its reply. A Redis error reply is returned as
+// an error.
+func (rc *respConn) do(args ...string) (interface{}, error) {
+	if err := rc.send(args...); err != nil {
+		return nil, err
+	}
+	reply, err := rc.receive()
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(respError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+// send writes a command as an array of bulk strings.
+func (rc *respConn) send(args ...string) error {
+	rc.c.SetWriteDeadline(time.Now().Add(redisWriteTimeout))
+	fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return rc.w.Flush()
+}
+
+// wait waits up to d for a reply to begin arriving, without reading any of it,
+// for when replies are pushed by the server as with pub/sub.
+func (rc *respConn) wait(d time.Duration) error {
+	rc.c.SetReadDeadline(time.Now().Add(d))
+	_, err := rc.r.Peek(1)
+	return err
+}
+
+// receive reads a single reply, which will be a string, int64, respError, nil,
+// or []interface{} of those.
+func (rc *respConn) receive() (interface{}, error) {
+	rc.c.SetReadDeadline(time.Now().Add(rc.timeout))
+	return readRESP(rc.r)
+}
+
+// respError is an error reply from Redis.
+type respError string
+
+func (e respError) Error() string { return "redis: " + string(e) }
+
+var errMalformedRESP = errors.New("redis: malformed reply")
+
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errMalformedRESP
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return respError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errMalformedRESP
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errMalformedRESP
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errMalformedRESP
+}
@@ -0,0 +1,290 @@
+package sseserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server, implementing just
+// enough of the protocol for pub/sub.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu        sync.Mutex
+	clients   map[*fakeRedisClient]bool
+	published []string // channels published to
+}
+
+type fakeRedisClient struct {
+	c       net.Conn
+	mu      sync.Mutex // Guards writes to c
+	pattern string     // set once subscribed
+	hung    bool       // stops responding, guarded by fakeRedis.mu
+}
+
+func (fc *fakeRedisClient) write(format string, args ...interface{}) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fmt.Fprintf(fc.c, format, args...)
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{ln: ln, password: password, clients: make(map[*fakeRedisClient]bool)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(&fakeRedisClient{c: c})
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) Addr() string { return r.ln.Addr().String() }
+
+func (r *fakeRedis) Close() {
+	r.ln.Close()
+	r.kick()
+}
+
+// kick disconnects all clients.
+func (r *fakeRedis) kick() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for fc := range r.clients {
+		fc.c.Close()
+		delete(r.clients, fc)
+	}
+}
+
+// hang stops responding to all clients, without disconnecting them, as if the
+// network between had failed.
+func (r *fakeRedis) hang() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for fc := range r.clients {
+		fc.hung = true
+	}
+}
+
+// subscribers returns the number of responsive clients which have subscribed.
+func (r *fakeRedis) subscribers() (n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for fc := range r.clients {
+		if fc.pattern != "" && !fc.hung {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *fakeRedis) serve(fc *fakeRedisClient) {
+	r.mu.Lock()
+	r.clients[fc] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.clients, fc)
+		r.mu.Unlock()
+		fc.c.Close()
+	}()
+
+	authed := r.password == ""
+	br := bufio.NewReader(fc.c)
+	for {
+		reply, err := readRESP(br)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		hung := fc.hung
+		r.mu.Unlock()
+		if hung {
+			continue
+		}
+		var args []string
+		for _, a := range reply.([]interface{}) {
+			args = append(args, a.(string))
+		}
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			if args[1] != r.password {
+				fc.write("-ERR invalid password\r\n")
+				continue
+			}
+			authed = true
+			fc.write("+OK\r\n")
+		case !authed:
+			fc.write("-NOAUTH Authentication required.\r\n")
+		case cmd == "PSUBSCRIBE":
+			r.mu.Lock()
+			fc.pattern = args[1]
+			r.mu.Unlock()
+			fc.write("*3\r\n$10\r\npsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		case cmd == "PUBLISH":
+			channel, payload := args[1], args[2]
+			r.mu.Lock()
+			r.published = append(r.published, channel)
+			var n int
+			for sub := range r.clients {
+				if sub.pattern != "" && !sub.hung && strings.HasPrefix(channel, strings.TrimSuffix(sub.pattern, "*")) {
+					sub.write("*4\r\n$8\r\npmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+						len(sub.pattern), sub.pattern, len(channel), channel, len(payload), payload)
+					n++
+				}
+			}
+			r.mu.Unlock()
+			fc.write(":%d\r\n", n)
+		case cmd == "PING":
+			if fc.pattern != "" {
+				fc.write("*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+			} else {
+				fc.write("+PONG\r\n")
+			}
+		default:
+			fc.write("-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// waitFor polls cond until it returns true, failing if it takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRedisBackplane(t *testing.T) {
+	redis := newFakeRedis(t, "hunter2")
+	defer redis.Close()
+
+	var backplanes []Backplane
+	for i := 0; i < 2; i++ {
+		b := NewRedisBackplane(RedisOptions{Addr: redis.Addr(), Password: "hunter2"})
+		defer b.Close()
+		backplanes = append(backplanes, b)
+	}
+	servers, conns := mockNodes("/pets", backplanes...)
+	waitFor(t, "subscriptions", func() bool { return redis.subscribers() == 2 })
+	for _, s := range servers {
+		if status := s.Status().Backplane; status == nil || !status.Connected {
+			t.Errorf("unexpected backplane status: %+v", status)
+		}
+	}
+
+	broadcast := func(s *Server) {
+		t.Helper()
+		s.Broadcast <- SSEMessage{Data: []byte("woof"), Namespace: "/pets/dogs", ID: "1"}
+		for i, c := range conns {
+			if f := receive(t, c); f != "id:1\ndata:woof\n\n" {
+				t.Errorf("node %d received unexpected msg: got %q", i, f)
+			}
+		}
+	}
+	broadcast(servers[0])
+
+	// after losing the connection, it should be re-established
+	redis.kick()
+	waitFor(t, "reconnection", func() bool {
+		status := servers[1].Status().Backplane
+		return status.Reconnects > 0 && status.Connected && redis.subscribers() == 2
+	})
+	broadcast(servers[1])
+
+	for i, s := range servers {
+		s.hub.Shutdown()
+		if extra := drain(conns[i]); len(extra) > 0 {
+			t.Errorf("node %d received unexpected msgs: %q", i, extra)
+		}
+	}
+	redis.mu.Lock()
+	defer redis.mu.Unlock()
+	expected := []string{"sseserver:/pets/dogs", "sseserver:/pets/dogs"}
+	if !reflect.DeepEqual(redis.published, expected) {
+		t.Errorf("unexpected channels published to: got %q want %q", redis.published, expected)
+	}
+}
+
+// a connection which stops responding without being closed should be noticed,
+// and re-established
+func TestRedisBackplaneHung(t *testing.T) {
+	redis := newFakeRedis(t, "")
+	defer redis.Close()
+	b := newRedisBackplane(RedisOptions{Addr: redis.Addr()}, 10*time.Millisecond, 50*time.Millisecond)
+	defer b.Close()
+	waitFor(t, "subscription", func() bool { return redis.subscribers() == 1 })
+
+	// while pings are answered, an idle connection is left alone
+	time.Sleep(100 * time.Millisecond)
+	if status := b.Status(); !status.Connected || status.Reconnects != 0 {
+		t.Errorf("unexpected status while idle: %+v", status)
+	}
+
+	redis.hang()
+	waitFor(t, "reconnection", func() bool {
+		status := b.Status()
+		return status.Reconnects >= 2 && status.Connected && redis.subscribers() == 1
+	})
+}
+
+func TestRedisBackplaneAuthFailure(t *testing.T) {
+	redis := newFakeRedis(t, "hunter2")
+	defer redis.Close()
+	b := NewRedisBackplane(RedisOptions{Addr: redis.Addr(), Password: "*******"})
+	defer b.Close()
+
+	waitFor(t, "failure", func() bool { return b.Status().LastError != "" })
+	status := b.Status()
+	if status.Connected {
+		t.Error("unexpectedly connected")
+	}
+	if expected := "redis: ERR invalid password"; status.LastError != expected {
+		t.Errorf("unexpected error: got %q want %q", status.LastError, expected)
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	var respTests = []struct {
+		input    string
+		expected interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR nope\r\n", respError("ERR nope")},
+		{":42\r\n", int64(42)},
+		{"$5\r\nhe\r\nl\r\n", "he\r\nl"},
+		{"$-1\r\n", nil},
+		{"*2\r\n$1\r\na\r\n:1\r\n", []interface{}{"a", int64(1)}},
+	}
+	for _, tc := range respTests {
+		actual, err := readRESP(bufio.NewReader(strings.NewReader(tc.input)))
+		if err != nil {
+			t.Errorf("readRESP(%q): unexpected error %v", tc.input, err)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("readRESP(%q): got %#v want %#v", tc.input, actual, tc.expected)
+		}
+	}
+
+	if _, err := readRESP(bufio.NewReader(strings.NewReader("?\r\n"))); err != errMalformedRESP {
+		t.Errorf("unexpected error for malformed reply: got %v want %v", err, errMalformedRESP)
+	}
+}
@@ -0,0 +1,125 @@
+package sseserver
+
+import "sort"
+
+// A replayStore keeps a history of broadcast messages, so that clients
+// reconnecting with a Last-Event-ID can be sent the messages they missed.
+//
+// Methods are only called from the hub run loop.
+type replayStore interface {
+	// add records a message and its formatted frame.
+	add(msg SSEMessage, frame []byte)
+	// since returns the formatted messages broadcast after the message with
+	// the given lastID, for which wants returns true, in the order they were
+	// originally broadcast. If there are more than limit, only the most recent
+	// are returned.
+	//
+	// Should an ID have been reused, the most recent occurrence is used. If
+	// lastID can not be found (e.g. it has already aged out of the store)
+	// there is no way to know what was missed, so ok is false.
+	since(lastID string, wants func(namespace, event string) bool, limit int) (frames [][]byte, ok bool)
+}
+
+// replayEntry is a single previously broadcast message retained for replay.
+type replayEntry struct {
+	seq   uint64 // hub-wide sequence number, used to order across namespaces
+	id    string // the event ID of the message
+	event string // the event type of the message
+	frame []byte // the already formatted SSE message
+}
+
+// ring is a fixed capacity circular buffer of replayEntry, once full the oldest
+// entries are overwritten.
+type ring struct {
+	entries []replayEntry
+	next    int // index the next entry will be written to
+	full    bool
+}
+
+func newRing(size int) *ring {
+	return &ring{entries: make([]replayEntry, size)}
+}
+
+func (r *ring) add(e replayEntry) {
+	r.entries[r.next] = e
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// each calls fn for every entry in the ring, from oldest to newest.
+func (r *ring) each(fn func(e replayEntry)) {
+	if r.full {
+		for _, e := range r.entries[r.next:] {
+			fn(e)
+		}
+	}
+	for _, e := range r.entries[:r.next] {
+		fn(e)
+	}
+}
+
+// replayBuffer is an in-memory replayStore, which keeps a bounded history of
+// recently broadcast messages for each namespace.
+//
+// Rings are never removed, so memory grows with the number of namespaces ever
+// broadcast to, times the ring size. Where namespaces are many and short-lived,
+// a Journal is a better fit.
+//
+// A replayBuffer is not safe for concurrent use, it is owned by the hub run loop.
+type replayBuffer struct {
+	rings map[string]*ring
+	size  int // capacity of each ring
+	seq   uint64
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{rings: make(map[string]*ring), size: size}
+}
+
+// add records a message and its formatted frame in the ring for its namespace,
+// which will be created if it does not already exist.
+func (rb *replayBuffer) add(msg SSEMessage, frame []byte) {
+	r, ok := rb.rings[msg.Namespace]
+	if !ok {
+		r = newRing(rb.size)
+		rb.rings[msg.Namespace] = r
+	}
+	rb.seq++
+	r.add(replayEntry{seq: rb.seq, id: msg.ID, event: msg.Event, frame: frame})
+}
+
+func (rb *replayBuffer) since(lastID string, wants func(namespace, event string) bool, limit int) ([][]byte, bool) {
+	var (
+		matched []replayEntry
+		found   bool
+		lastSeq uint64
+	)
+	for ns, r := range rb.rings {
+		r.each(func(e replayEntry) {
+			if e.id == lastID && e.seq > lastSeq {
+				found, lastSeq = true, e.seq
+			}
+			if wants(ns, e.event) {
+				matched = append(matched, e)
+			}
+		})
+	}
+	if !found {
+		return nil, false
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return matched[i].seq < matched[j].seq })
+	var frames [][]byte
+	for _, e := range matched {
+		if e.seq > lastSeq {
+			frames = append(frames, e.frame)
+		}
+	}
+	if len(frames) > limit {
+		frames = frames[len(frames)-limit:]
+	}
+	return frames, true
+}
@@ -0,0 +1,43 @@
+package sseserver
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRingOverwritesOldest(t *testing.T) {
+	r := newRing(3)
+	for i := 1; i <= 5; i++ {
+		r.add(replayEntry{seq: uint64(i)})
+	}
+
+	var seqs []uint64
+	r.each(func(e replayEntry) { seqs = append(seqs, e.seq) })
+	expected := []uint64{3, 4, 5}
+	if len(seqs) != len(expected) {
+		t.Fatalf("unexpected entries: got %v want %v", seqs, expected)
+	}
+	for i := range expected {
+		if seqs[i] != expected[i] {
+			t.Fatalf("unexpected entries: got %v want %v", seqs, expected)
+		}
+	}
+}
+
+// once the Last-Event-ID has aged out of the buffer, we dont know what the
+// client missed, so we shouldn't guess.
+func TestReplaySinceExpired(t *testing.T) {
+	rb := newReplayBuffer(2)
+	for i := 1; i <= 5; i++ {
+		id := strconv.Itoa(i)
+		rb.add(SSEMessage{Namespace: "/foo", ID: id}, []byte(id))
+	}
+	all := func(string, string) bool { return true }
+
+	if frames, ok := rb.since("1", all, 10); ok {
+		t.Errorf("expected expired ID to not be found, got %q", frames)
+	}
+	if frames, _ := rb.since("4", all, 10); len(frames) != 1 || string(frames[0]) != "5" {
+		t.Errorf("unexpected frames: got %q want %q", frames, []string{"5"})
+	}
+}
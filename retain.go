@@ -0,0 +1,67 @@
+package sseserver
+
+import (
+	"sort"
+	"time"
+)
+
+// retainedMsg is the latest retained message for a namespace.
+type retainedMsg struct {
+	seq     uint64    // order retained in, so they are sent in the same order
+	event   string    // the event type of the message
+	frame   []byte    // the already formatted SSE message
+	expires time.Time // zero if never
+}
+
+// retainedStore keeps the latest retained message for each exact namespace, to
+// be sent to new subscribers.
+//
+// A retainedStore is not safe for concurrent use, it is owned by the hub run loop.
+type retainedStore struct {
+	msgs map[string]retainedMsg
+	seq  uint64
+}
+
+func newRetainedStore() *retainedStore {
+	return &retainedStore{msgs: make(map[string]retainedMsg)}
+}
+
+// set retains a message and its formatted frame as the latest for its
+// namespace, or clears it if the message has no Data.
+func (rs *retainedStore) set(msg SSEMessage, frame []byte, now time.Time) {
+	if msg.clearsRetained() {
+		delete(rs.msgs, msg.Namespace)
+		return
+	}
+	rs.seq++
+	rm := retainedMsg{seq: rs.seq, event: msg.Event, frame: frame}
+	if msg.RetainFor > 0 {
+		rm.expires = now.Add(msg.RetainFor)
+	}
+	rs.msgs[msg.Namespace] = rm
+}
+
+// matching returns the formatted retained messages for which wants returns
+// true, in the order they were retained. If there are more than limit, only
+// the most recent are returned. Expired messages are removed.
+func (rs *retainedStore) matching(wants func(namespace, event string) bool, limit int, now time.Time) [][]byte {
+	var matched []retainedMsg
+	for ns, rm := range rs.msgs {
+		if !rm.expires.IsZero() && now.After(rm.expires) {
+			delete(rs.msgs, ns)
+			continue
+		}
+		if wants(ns, rm.event) {
+			matched = append(matched, rm)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].seq < matched[j].seq })
+	if len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	frames := make([][]byte, len(matched))
+	for i, rm := range matched {
+		frames[i] = rm.frame
+	}
+	return frames
+}
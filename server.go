@@ -1,8 +1,12 @@
 package sseserver
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Server is the primary interface to a SSE server.
@@ -17,13 +21,152 @@ type Server struct {
 	Broadcast chan<- SSEMessage
 	Options   ServerOptions
 	hub       *hub
+
+	mu         sync.Mutex   // Guards httpServer
+	httpServer *http.Server // Set when using the Serve convenience method
 }
 
 // ServerOptions defines a set of high-level user options that can be customized
 // for a Server.
+//
+// Options should be set prior to the Server handling any connections or
+// messages, changing them afterwards is not safe for concurrent use.
 type ServerOptions struct {
 	DisableAdminEndpoints bool // disables the "/admin" status endpoints
 	// DisallowRootSubscribe bool // TODO: possibly consider this option?
+
+	// Authorizer, if set, decides whether each request may subscribe to the
+	// namespaces it asks for, see Authorizer. Otherwise anyone may subscribe
+	// to anything.
+	Authorizer Authorizer
+	// PublishAuthorizer, if set, enables the "/publish/" endpoint, for
+	// producers unable to use Broadcast or Publish directly, and decides
+	// whether each request may publish to the namespace it is for. Only the
+	// Deny, Status and Body of its Authorization are used.
+	PublishAuthorizer Authorizer
+	// AdminAuthorizer, if set, enables kicking connections through the
+	// "/admin/connections/:id/kick" endpoint, and decides whether each
+	// request may kick the connection it is for, given the namespace of that
+	// connection. Only the Deny, Status and Body of its Authorization are
+	// used. Requests from other origins are always refused.
+	AdminAuthorizer Authorizer
+
+	// CORS determines which web pages on other origins may subscribe, see
+	// CORSOptions. Defaults to allowing any origin, without credentials.
+	CORS *CORSOptions
+
+	// ReplayBufferSize is the number of recent messages kept per namespace so
+	// that reconnecting clients sending a Last-Event-ID can be sent the
+	// messages they missed. When enabled, messages broadcast without an ID
+	// will automatically be assigned one. Zero (the default) disables replay.
+	// The history of a namespace is kept for as long as the Server runs, so
+	// memory use grows with the number of namespaces broadcast to.
+	ReplayBufferSize int
+	// Journal, if set, is used to keep the history of messages for replay on
+	// disk rather than in memory, so that it survives restarts. The
+	// ReplayBufferSize is then ignored, see Journal.
+	Journal *Journal
+
+	// RetryInterval, if set, is sent as the first frame of every stream to
+	// tell the client how long to wait before reconnecting. Otherwise clients
+	// use their own default (typically a few seconds).
+	RetryInterval time.Duration
+	// RetryJitter adds a random duration of up to this amount to the
+	// RetryInterval of each connection, spreading out reconnection storms
+	// when many clients are disconnected at once, e.g. during a deploy.
+	RetryJitter time.Duration
+
+	// ConnectionBufferSize is the number of messages that can be queued for a
+	// connection before it is considered a slow consumer. Defaults to 256.
+	ConnectionBufferSize int
+	// SlowConsumerPolicy determines how connections which fill their buffer
+	// are handled, see SlowConsumerPolicy. Defaults to disconnecting them.
+	SlowConsumerPolicy SlowConsumerPolicy
+	// SlowConsumerTimeout is how long a connection may remain continuously
+	// full before it is disconnected anyway, when using a policy that does not
+	// otherwise disconnect. Zero means never.
+	SlowConsumerTimeout time.Duration
+
+	// KeepaliveInterval is how long a connection may go without anything
+	// being written to it before a keepalive is sent, to stop proxies and load
+	// balancers closing it for being idle. Defaults to 15 seconds.
+	KeepaliveInterval time.Duration
+	// KeepalivePayload is the text of a keepalive, sent as a comment which
+	// clients ignore. Defaults to "keepalive".
+	KeepalivePayload string
+	// KeepaliveEvent, if set, sends keepalives as an event of this type, with
+	// the KeepalivePayload as its Data, rather than a comment, for clients
+	// which want to detect a dead connection themselves.
+	KeepaliveEvent string
+
+	// ShutdownMessage, if set, is sent to every connection regardless of
+	// namespace when the Server is shutdown, for example an event telling
+	// clients to reconnect elsewhere along with a Retry hint.
+	ShutdownMessage *SSEMessage
+
+	// Shards is the number of goroutines broadcast messages are delivered
+	// from, each handling an equal share of the connections, allowing
+	// broadcasting to many connections to make use of multiple cores. Message
+	// ordering is preserved for each connection. Defaults to 1.
+	Shards int
+
+	// Backplane, if set, connects the Server to others so that messages
+	// broadcast on any of them are delivered to subscribers on all of them,
+	// see Backplane.
+	Backplane Backplane
+	// NodeID identifies the Server to others on the Backplane, and must be
+	// unique amongst them. Defaults to a randomly generated ID.
+	NodeID string
+
+	// PresenceEvents enables broadcasting a "presence" event into a namespace
+	// whenever the number of connections subscribed to it (see
+	// Server.Presence) changes, with Data such as
+	// {"namespace":"/pets","count":3}. Events are sent at most once every
+	// PresenceInterval, which defaults to one second, with the latest count.
+	PresenceEvents   bool
+	PresenceInterval time.Duration
+
+	// OnConnect, if set, is called for each new connection once it has been
+	// registered to receive messages.
+	OnConnect func(conn ConnectionInfo)
+	// OnDisconnect, if set, is called for each connection once it has ended,
+	// with the reason why.
+	OnDisconnect func(conn ConnectionInfo, reason DisconnectReason)
+	// OnDrop, if set, is called for each formatted message discarded by the
+	// SlowConsumerPolicy rather than being sent to a connection.
+	//
+	// The hooks are called one at a time in the order the events occurred,
+	// from a goroutine of their own so as not to hold up broadcasting, so may
+	// be called some time after the event.
+	OnDrop func(conn ConnectionInfo, policy SlowConsumerPolicy, frame []byte)
+
+	// Namespaces allows overriding some options for specific namespaces (and
+	// their children), keyed by namespace. The most specific match is used.
+	Namespaces map[string]NamespaceOptions
+}
+
+// ErrServerClosed is returned by Server.Publish after the Server has been
+// Shutdown.
+var ErrServerClosed = errors.New("sseserver: Server closed")
+
+// DeliveryReport describes what happened to a published message.
+//
+// Every connection subscribed to the message's namespace is counted in Matched,
+// and then exactly one of Queued, Dropped, or Disconnected depending on whether
+// there was room in its send buffer and the SlowConsumerPolicy in effect.
+type DeliveryReport struct {
+	Matched      int `json:"matched"`      // connections subscribed to the namespace
+	Queued       int `json:"queued"`       // msg queued for delivery
+	Dropped      int `json:"dropped"`      // msg discarded due to a full buffer
+	Disconnected int `json:"disconnected"` // connection closed due to a full buffer
+}
+
+// add sums another DeliveryReport into r.
+func (r *DeliveryReport) add(o DeliveryReport) {
+	r.Matched += o.Matched
+	r.Queued += o.Queued
+	r.Dropped += o.Dropped
+	r.Disconnected += o.Disconnected
 }
 
 // NewServer creates a new Server and returns a reference to it.
@@ -31,6 +174,7 @@ func NewServer() *Server {
 	s := Server{
 		hub: newHub(),
 	}
+	s.hub.opts = &s.Options
 
 	// start up our actual internal connection hub
 	// which we keep in the server struct as private
@@ -43,13 +187,33 @@ func NewServer() *Server {
 	return &s
 }
 
+// Publish broadcasts a message, in the same way as sending it to Broadcast, and
+// reports how it was delivered.
+//
+// Publish blocks until the message has been accepted for broadcasting, which
+// can be abandoned via ctx. Once accepted, the message will be delivered
+// regardless of ctx, and the report returned shortly after.
+func (s *Server) Publish(ctx context.Context, msg SSEMessage) (DeliveryReport, error) {
+	req := publishRequest{msg: msg, tally: newDeliveryTally()}
+	select {
+	case s.hub.publish <- req:
+	case <-s.hub.done:
+		return DeliveryReport{}, ErrServerClosed
+	case <-ctx.Done():
+		return DeliveryReport{}, ctx.Err()
+	}
+	return <-req.tally.done, nil
+}
+
 // ServeHTTP implements the http.Handler interface
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mux := http.NewServeMux()
-	mux.Handle(
-		"/subscribe/",
-		http.StripPrefix("/subscribe", connectionHandler(s.hub)),
-	)
+	subscribe := http.StripPrefix("/subscribe", connectionHandler(s.hub))
+	mux.Handle("/subscribe/", subscribe)
+	mux.Handle("/subscribe", subscribe) // for e.g. "/subscribe?ns=/foo&ns=/bar"
+	publish := http.StripPrefix("/publish", publishHandler(s))
+	mux.Handle("/publish/", publish)
+	mux.Handle("/publish", publish)
 	mux.Handle(
 		"/admin/",
 		adminHandler(s),
@@ -59,8 +223,8 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Serve is a convenience method to begin serving connections on specified address.
 //
-// This method blocks forever, as it is basically a convenience wrapper around
-// http.ListenAndServe(addr, self).
+// This method blocks until the Server is Shutdown, as it is basically a
+// convenience wrapper around http.ListenAndServe(addr, self).
 //
 // It also implements basic request logging to STDOUT.
 //
@@ -70,11 +234,59 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *Server) Serve(addr string) {
 	log.Println("Starting server on addr " + addr)
 	handler := ProxyRemoteAddrHandler(requestLogger(s))
-	if err := http.ListenAndServe(addr, handler); err != nil {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	s.mu.Lock()
+	s.httpServer = srv
+	s.mu.Unlock()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe:", err)
 	}
 }
 
+// Shutdown gracefully shuts down the Server.
+//
+// New subscriptions are refused, every open connection is sent the
+// ShutdownMessage (if set) and then closed, and the internal hub is stopped.
+// Shutdown waits for all connections to finish writing before returning, or
+// returns the context's error if it expires first. If the Server was started
+// with Serve, the underlying HTTP server is shutdown as well.
+//
+// Once Shutdown has been called, nothing further should be sent to the
+// Broadcast channel, as there is no longer anything receiving from it.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.hub.stopAccepting()
+	select {
+	case s.hub.shutdown <- true:
+	case <-s.hub.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-s.hub.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.hub.handlers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	srv := s.httpServer
+	s.mu.Unlock()
+	if srv != nil {
+		return srv.Shutdown(ctx)
+	}
+	return nil
+}
+
 // ProxyRemoteAddrHandler is HTTP middleware to determine the actual RemoteAddr
 // of a http.Request when your server sits behind a proxy or load balancer.
 //
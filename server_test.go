@@ -0,0 +1,127 @@
+package sseserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribe opens a streaming connection to namespace on a test server. The
+// connection is registered with the hub by the time headers are received.
+func subscribe(t *testing.T, ts *httptest.Server, namespace string) *http.Response {
+	t.Helper()
+	res, err := http.Get(ts.URL + "/subscribe" + namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status subscribing: got %v want %v", res.StatusCode, http.StatusOK)
+	}
+	return res
+}
+
+// Shutdown should say goodbye to existing connections, close them, and refuse
+// any new ones.
+func TestServerShutdown(t *testing.T) {
+	s := NewServer()
+	s.Options.ShutdownMessage = &SSEMessage{Event: "reconnect", Retry: 5 * time.Second}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	res := subscribe(t, ts, "/pets")
+	defer res.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal("unexpected error shutting down:", err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal("error reading body:", err)
+	}
+	if expected := "retry:5000\nevent:reconnect\ndata:\n\n"; !strings.HasSuffix(string(body), expected) {
+		t.Errorf("farewell message not received: got %q want suffix %q", body, expected)
+	}
+
+	res2, err := http.Get(ts.URL + "/subscribe/pets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2.Body.Close()
+	if res2.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status after shutdown: got %v want %v",
+			res2.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	// shutting down again should be harmless
+	if err := s.Shutdown(ctx); err != nil {
+		t.Error("unexpected error on second shutdown:", err)
+	}
+}
+
+// Shutdown should give up waiting once its context expires.
+func TestServerShutdownContext(t *testing.T) {
+	s := NewServer()
+	defer s.hub.Shutdown()
+
+	// a handler which never exits
+	if !s.hub.acquire() {
+		t.Fatal("hub unexpectedly not accepting connections")
+	}
+	defer s.hub.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: got %v want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestServerPublish(t *testing.T) {
+	s := NewServer()
+	s.Options.Namespaces = map[string]NamespaceOptions{
+		"/pets/dogs": {SlowConsumerPolicy: SlowConsumerDropNewest},
+	}
+	s.hub.register <- mockSinkedConn("/pets", s.hub)
+	s.hub.register <- mockConn("/pets/cats")
+	mockFullConn("/pets", s.hub)
+	mockFullConn("/pets/dogs", s.hub)
+
+	ctx := context.Background()
+	report, err := s.Publish(ctx, SSEMessage{Data: []byte("woof"), Namespace: "/pets/dogs"})
+	if err != nil {
+		t.Fatal("unexpected error publishing:", err)
+	}
+	expected := DeliveryReport{Matched: 3, Queued: 1, Dropped: 2}
+	if report != expected {
+		t.Errorf("unexpected report: got %+v want %+v", report, expected)
+	}
+
+	report, _ = s.Publish(ctx, SSEMessage{Data: []byte("meow"), Namespace: "/pets/cats"})
+	expected = DeliveryReport{Matched: 3, Queued: 2, Disconnected: 1}
+	if report != expected {
+		t.Errorf("unexpected report: got %+v want %+v", report, expected)
+	}
+
+	s.hub.Shutdown()
+	if _, err := s.Publish(ctx, SSEMessage{Data: []byte("hi")}); err != ErrServerClosed {
+		t.Errorf("unexpected error after shutdown: got %v want %v", err, ErrServerClosed)
+	}
+}
+
+// a cancelled Publish should not wait on a hub that will never accept it
+func TestServerPublishCancel(t *testing.T) {
+	h := newHub() // never started
+	s := &Server{hub: h}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Publish(ctx, SSEMessage{Data: []byte("hi")}); err != context.Canceled {
+		t.Errorf("unexpected error: got %v want %v", err, context.Canceled)
+	}
+}
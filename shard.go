@@ -0,0 +1,267 @@
+package sseserver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azer/debug"
+)
+
+// shardQueueSize is the number of operations which can be queued for a shard
+// before the hub blocks waiting for it, allowing shards to briefly fall behind
+// one another without stalling the rest.
+const shardQueueSize = 64
+
+// A shard owns a subset of the hub's connections, and delivers broadcast
+// messages to them in its own run loop, so that the fan-out of a broadcast can
+// be spread across multiple cores.
+//
+// All operations for a shard arrive in order on a single channel, so that each
+// connection sees registration and messages in the order the hub sent them.
+type shard struct {
+	ops         chan shardOp         // Inbound operations from the hub.
+	done        chan struct{}        // Closed once the run loop has exited
+	opts        *ServerOptions       // User options, owned by the Server
+	hooks       *hookDispatcher      // Runs user hooks, shared with the hub
+	connections map[*connection]bool // Registered connections.
+	index       *nsIndex             // Registered connections by subscription.
+	matchGen    uint64               // Incremented for each broadcast, for dedupe.
+	slowStats   SlowConsumerStats    // Outcomes of slow consumer policies
+	queueDepth  *histogram           // Send buffer lengths seen when queueing msgs
+}
+
+type shardOpKind int
+
+const (
+	opRegister shardOpKind = iota
+	opUnregister
+	opBroadcast
+	opQuery
+	opShutdown
+)
+
+// shardOp is a single operation for a shard to perform, only the fields
+// relevant to its kind are set.
+type shardOp struct {
+	kind  shardOpKind
+	conn  *connection    // register, unregister
+	msg   SSEMessage     // broadcast
+	frame []byte         // broadcast: formatted msg, shutdown: farewell msg
+	at    time.Time      // broadcast: when the hub accepted the msg
+	tally *deliveryTally // broadcast: where to report delivery, may be nil
+	query *shardQuery    // query
+}
+
+// deliveryTally sums the DeliveryReport for a message across all shards, and
+// sends the total on done once all of them have reported.
+type deliveryTally struct {
+	mu      sync.Mutex
+	report  DeliveryReport
+	pending int                 // shards yet to report, set by the hub
+	done    chan DeliveryReport // must be buffered
+}
+
+func newDeliveryTally() *deliveryTally {
+	return &deliveryTally{done: make(chan DeliveryReport, 1)}
+}
+
+func (t *deliveryTally) add(r DeliveryReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.report.add(r)
+	t.pending--
+	if t.pending == 0 {
+		t.done <- t.report
+	}
+}
+
+// shardQuery is a function to run in the run loop of every shard, done is
+// closed once all of them have done so. If set, hubFn is first run in the hub
+// run loop.
+type shardQuery struct {
+	hubFn   func(h *hub)
+	fn      func(sh *shard)
+	pending int32 // shards yet to run fn, set by the hub
+	done    chan struct{}
+}
+
+func newShard(opts *ServerOptions, hooks *hookDispatcher) *shard {
+	return &shard{
+		ops:         make(chan shardOp, shardQueueSize),
+		done:        make(chan struct{}),
+		opts:        opts,
+		hooks:       hooks,
+		connections: make(map[*connection]bool),
+		index:       newNSIndex(),
+		queueDepth:  newQueueDepthHistogram(),
+	}
+}
+
+func (sh *shard) run() {
+	for op := range sh.ops {
+		switch op.kind {
+		case opRegister:
+			sh._registerConn(op.conn)
+		case opUnregister:
+			sh._unregisterConn(op.conn)
+		case opBroadcast:
+			report := sh._broadcastMessage(op.msg, queuedMsg{frame: op.frame, at: op.at})
+			if op.tally != nil {
+				op.tally.add(report)
+			}
+		case opQuery:
+			if op.query.fn != nil {
+				op.query.fn(sh)
+			}
+			if atomic.AddInt32(&op.query.pending, -1) == 0 {
+				close(op.query.done)
+			}
+		case opShutdown:
+			for c := range sh.connections {
+				sh._sendFarewell(c, op.frame)
+				sh._shutdownConn(c, DisconnectShutdown)
+			}
+			close(sh.done)
+			return
+		}
+	}
+}
+
+// internal method, adds a client to the shard
+// _register is safe to call multiple times with the same connection
+func (sh *shard) _registerConn(c *connection) {
+	if sh.connections[c] {
+		return
+	}
+	sh.connections[c] = true
+	for _, ns := range c.namespaces {
+		sh.index.add(ns, c)
+	}
+}
+
+// internal method, removes that client from the shard
+// _unregister is safe to call multiple times with the same connection
+func (sh *shard) _unregisterConn(c *connection) {
+	if !sh.connections[c] {
+		return
+	}
+	delete(sh.connections, c)
+	for _, ns := range c.namespaces {
+		sh.index.remove(ns, c)
+	}
+}
+
+// internal method, queues a formatted message for a connection which is about
+// to be shutdown, if set and there is room for it.
+func (sh *shard) _sendFarewell(c *connection, frame []byte) {
+	if frame == nil {
+		return
+	}
+	select {
+	case c.send <- queuedMsg{frame: frame, at: time.Now()}:
+	default: // no room, they will have to find out the hard way
+	}
+}
+
+// internal method, removes that client from the shard and tells it to shutdown
+// for the given reason.
+// must only be called once for a given connection to avoid panic!
+func (sh *shard) _shutdownConn(c *connection, reason DisconnectReason) {
+	// for maximum safety, ALWAYS unregister a connection from the shard prior
+	// to shutting it down, as we want no possibility of a send on closed
+	// channel panic.
+	sh._unregisterConn(c)
+	// close the connection's send channel, which will cause it to exit its
+	// event loop and return to the HTTP handler.
+	c.closeReason = reason
+	close(c.send)
+}
+
+// internal method, deliver an already formatted message to all matching
+// clients, applying the slow consumer policy for any client that has a full
+// send buffer.
+func (sh *shard) _broadcastMessage(msg SSEMessage, formattedMsg queuedMsg) (report DeliveryReport) {
+	sh.matchGen++
+	sh.index.match(msg.Namespace, func(c *connection) {
+		// a connection may match via multiple subscriptions, only send once
+		if c.matchGen == sh.matchGen || !c.events.allows(msg.Event) {
+			return
+		}
+		c.matchGen = sh.matchGen
+		report.Matched++
+		sh.queueDepth.observe(uint64(len(c.send)))
+		select {
+		case c.send <- formattedMsg:
+			c.stalledSince = time.Time{}
+			report.Queued++
+		default:
+			switch sh._handleSlowConsumer(c, msg.Namespace, formattedMsg) {
+			case SlowConsumerDisconnect:
+				report.Disconnected++
+			case SlowConsumerDropNewest:
+				report.Dropped++
+			default:
+				report.Queued++
+			}
+		}
+	})
+	return report
+}
+
+// internal method, handles a formatted message that could not be queued for a
+// connection because its send buffer is full. Returns the policy applied.
+func (sh *shard) _handleSlowConsumer(c *connection, namespace string, formattedMsg queuedMsg) SlowConsumerPolicy {
+	policy := sh.opts.slowConsumerPolicy(namespace)
+	if policy != SlowConsumerDisconnect {
+		if c.stalledSince.IsZero() {
+			c.stalledSince = time.Now()
+		} else if sh.opts.stalled(c.stalledSince) {
+			debug.Debug("connection has been stalled too long, disconnecting")
+			policy = SlowConsumerDisconnect
+		}
+	}
+
+	switch policy {
+	case SlowConsumerDropOldest:
+		select {
+		case dropped := <-c.send:
+			sh.slowStats.DroppedOldest++
+			sh.onDrop(c, policy, dropped.frame)
+		default: // writer emptied a slot in the meantime
+		}
+		c.send <- formattedMsg // we are the only sender, so this cant block
+	case SlowConsumerDropNewest:
+		sh.slowStats.DroppedNewest++
+		sh.onDrop(c, policy, formattedMsg.frame)
+	case SlowConsumerConflate:
+		for drained := false; !drained; {
+			select {
+			case dropped := <-c.send:
+				sh.slowStats.Conflated++
+				sh.onDrop(c, policy, dropped.frame)
+			default:
+				drained = true
+			}
+		}
+		c.send <- formattedMsg
+	default:
+		debug.Debug("cant pass to a connection send chan, buffer is full -- kill it with fire")
+		sh.slowStats.Disconnected++
+		sh._shutdownConn(c, DisconnectBufferFull)
+		/*
+			we are already closing the send channel, in *theory* shouldn't the
+			connection clean up? I guess possible it doesnt if its deadlocked or
+			something... is it?
+
+			closing the send channel will result in our handleFunc exiting, which Go
+			treats as meaning we are done with the connection... but what if it's wedged?
+
+			TODO: investigate using panic in a http.Handler, to absolutely force
+
+			we want to make sure to always close the HTTP connection though,
+			so server can never fill up max num of open sockets.
+		*/
+	}
+	return policy
+}
@@ -0,0 +1,172 @@
+package sseserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenClaims are the claims of a subscription token, see TokenAuthorizer.
+type TokenClaims struct {
+	// Subject identifies the client, and becomes the Identity of the
+	// connection.
+	Subject string `json:"sub,omitempty"`
+	// Namespaces the client may subscribe to, along with their children.
+	Namespaces []string `json:"namespaces"`
+	// Events, if set, are the only event types the client may receive.
+	Events []string `json:"events,omitempty"`
+	// ExpiresAt is when the token lapses, in seconds since the Unix epoch.
+	// Connections are disconnected at this time. Zero means never.
+	ExpiresAt int64 `json:"exp,omitempty"`
+	// NotBefore is when the token becomes valid, in seconds since the Unix
+	// epoch. Zero means immediately.
+	NotBefore int64 `json:"nbf,omitempty"`
+}
+
+// allows reports whether the claims permit subscribing to namespace, which may
+// itself contain wildcards, see coversNamespace.
+func (tc *TokenClaims) allows(namespace string) bool {
+	for _, ns := range tc.Namespaces {
+		if coversNamespace(ns, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors returned when verifying a token.
+var (
+	ErrTokenInvalid = errors.New("sseserver: invalid token")
+	ErrTokenExpired = errors.New("sseserver: token expired")
+)
+
+// TokenAuthorizer is an Authorizer which checks for a token signed with a key
+// shared with whatever issues them, typically the backend serving the pages
+// which subscribe, so that a Server need not be able to check their sessions
+// itself.
+//
+// Tokens are JSON Web Tokens (JWT) signed with HMAC-SHA256 ("HS256"), whose
+// claims are a TokenClaims. A token is read from the "token" query parameter,
+// which unlike headers can be set when using EventSource, or otherwise from
+// an "Authorization: Bearer" header.
+//
+// Requests without a valid token are denied with 401 Unauthorized, and those
+// for a namespace the token does not permit with 403 Forbidden. As the token
+// is checked only when connecting, tokens should be short-lived, and carry an
+// expiry so that connections are disconnected when they lapse.
+type TokenAuthorizer struct {
+	key    []byte
+	leeway time.Duration
+	now    func() time.Time // for testing
+}
+
+// NewTokenAuthorizer creates a TokenAuthorizer which verifies tokens signed
+// with key. Expiry and not before times are allowed to be out by leeway, to
+// allow for clock skew between the issuer and the Server.
+func NewTokenAuthorizer(key []byte, leeway time.Duration) *TokenAuthorizer {
+	return &TokenAuthorizer{key: key, leeway: leeway, now: time.Now}
+}
+
+// Authorize checks the request has a valid token which permits subscribing to
+// namespace, see TokenAuthorizer.
+func (a *TokenAuthorizer) Authorize(r *http.Request, namespace string) Authorization {
+	token := requestToken(r)
+	if token == "" {
+		return Authorization{Deny: true, Status: http.StatusUnauthorized, Body: "401 token required"}
+	}
+	claims, err := a.Verify(token)
+	if err != nil {
+		return Authorization{
+			Deny:   true,
+			Status: http.StatusUnauthorized,
+			Body:   "401 " + strings.TrimPrefix(err.Error(), "sseserver: "),
+		}
+	}
+	if !claims.allows(namespace) {
+		return Authorization{Deny: true}
+	}
+	auth := Authorization{Identity: claims.Subject, Events: claims.Events}
+	if claims.ExpiresAt != 0 {
+		auth.Expires = time.Unix(claims.ExpiresAt, 0).Add(a.leeway)
+	}
+	return auth
+}
+
+// Sign returns a token for claims, signed with the key of the TokenAuthorizer.
+func (a *TokenAuthorizer) Sign(claims TokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(a.signature(signed)), nil
+}
+
+// Verify checks the signature and validity period of a token, returning its
+// claims.
+func (a *TokenAuthorizer) Verify(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, a.signature(parts[0]+"."+parts[1])) {
+		return nil, ErrTokenInvalid
+	}
+
+	// only trust what the token says about itself once it is known to be ours
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, ErrTokenInvalid
+	}
+	var claims TokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	now := a.now()
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(a.leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-a.leeway)) {
+		return nil, ErrTokenInvalid
+	}
+	return &claims, nil
+}
+
+// tokenHeader is the encoded JWT header of every token we sign.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (a *TokenAuthorizer) signature(signed string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// requestToken returns the token for a request, from its "token" query param
+// or "Authorization: Bearer" header.
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	const prefix = "Bearer "
+	if h := r.Header.Get("Authorization"); len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return strings.TrimSpace(h[len(prefix):])
+	}
+	return ""
+}